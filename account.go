@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const accountExportMediaMaxSize = 50 << 20
+
+// accountHandler (DELETE /api/account) удаляет аккаунт пользователя.
+// Строки в базе удаляются сразу в одной транзакции, файлы в хранилище — в фоне;
+// ход удаления можно проверить по GET /api/account/deletions/{id}.
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	job, err := deleteAccount(userID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка удаления аккаунта", nil, err)
+		return
+	}
+
+	go runAccountDeletion(job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// deleteAccount удаляет данные пользователя и создаёт задачу на удаление его файлов.
+// Покупки не удаляются, а обезличиваются: transaction_id нужен, чтобы повторный webhook
+// RevenueCat не начислил сообщения второй раз.
+func deleteAccount(userID string) (AccountDeletion, error) {
+	var job AccountDeletion
+
+	tx, err := db.Begin()
+	if err != nil {
+		return job, err
+	}
+	defer tx.Rollback()
+
+	var imagePaths, voicePaths []string
+	err = tx.QueryRow(`
+		SELECT COALESCE(array_agg(DISTINCT p) FILTER (WHERE kind = 'image'), '{}'),
+		       COALESCE(array_agg(DISTINCT p) FILTER (WHERE kind = 'voice'), '{}')
+		FROM (
+			SELECT unnest(m.image_paths) AS p, 'image' AS kind
+			FROM messages m JOIN chats c ON c.id = m.chat_id WHERE c.user_id = $1
+			UNION ALL
+			SELECT unnest(m.voice_paths) AS p, 'voice' AS kind
+			FROM messages m JOIN chats c ON c.id = m.chat_id WHERE c.user_id = $1
+			UNION ALL
+			SELECT voice_path AS p, 'voice' AS kind FROM transcription_jobs WHERE user_id = $1
+		) media
+	`, userID).Scan(pq.Array(&imagePaths), pq.Array(&voicePaths))
+	if err != nil {
+		return job, fmt.Errorf("ошибка получения файлов пользователя: %v", err)
+	}
+
+	statements := []string{
+		`DELETE FROM chat_shares WHERE chat_id IN (SELECT id FROM chats WHERE user_id = $1)`,
+		`DELETE FROM user_memories WHERE user_id = $1`,
+		`DELETE FROM usage_daily WHERE user_id = $1`,
+		`UPDATE chats SET active_leaf_id = NULL WHERE user_id = $1`,
+		`DELETE FROM messages WHERE chat_id IN (SELECT id FROM chats WHERE user_id = $1)`,
+		`DELETE FROM chats WHERE user_id = $1`,
+		`DELETE FROM transcription_jobs WHERE user_id = $1`,
+		`DELETE FROM user_credits WHERE user_id = $1`,
+		`UPDATE processed_transactions SET user_id = NULL WHERE user_id = $1`,
+		`DELETE FROM users WHERE id = $1`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return job, fmt.Errorf("ошибка удаления данных пользователя: %v", err)
+		}
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO account_deletions (status, image_paths, voice_paths, image_count, voice_count)
+		VALUES ('pending', $1, $2, $3, $4)
+		RETURNING id, status, created_at
+	`, pq.Array(imagePaths), pq.Array(voicePaths), len(imagePaths), len(voicePaths)).Scan(&job.ID, &job.Status, &createdAt)
+	if err != nil {
+		return job, fmt.Errorf("ошибка создания задачи удаления: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return job, err
+	}
+
+	job.ImageCount = len(imagePaths)
+	job.VoiceCount = len(voicePaths)
+	job.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	log.Printf("Удалён аккаунт, задача удаления файлов %s: картинок %d, голосовых %d", job.ID, job.ImageCount, job.VoiceCount)
+	return job, nil
+}
+
+// runAccountDeletion удаляет файлы удалённого аккаунта из обоих бакетов и отмечает результат в задаче.
+func runAccountDeletion(jobID string) {
+	var imagePaths, voicePaths []string
+	err := db.QueryRow(`
+		SELECT image_paths, voice_paths FROM account_deletions WHERE id = $1
+	`, jobID).Scan(pq.Array(&imagePaths), pq.Array(&voicePaths))
+	if err != nil {
+		log.Printf("Ошибка загрузки задачи удаления %s: %v", jobID, err)
+		return
+	}
+
+	err = deleteStorageObjects(os.Getenv("SUPABASE_BUCKET_NAME"), imagePaths)
+	if err == nil {
+		err = deleteStorageObjects(voiceBucketName, voicePaths)
+	}
+	if err != nil {
+		log.Printf("Ошибка удаления файлов аккаунта (задача %s): %v", jobID, err)
+		_, dbErr := db.Exec(`
+			UPDATE account_deletions SET status = 'failed', error = $2, updated_at = now() WHERE id = $1
+		`, jobID, err.Error())
+		if dbErr != nil {
+			log.Printf("Ошибка обновления задачи удаления %s: %v", jobID, dbErr)
+		}
+		return
+	}
+
+	// Пути больше не нужны — после удаления файлов в записи остаются только счётчики
+	_, err = db.Exec(`
+		UPDATE account_deletions
+		SET status = 'done', error = NULL, image_paths = '{}', voice_paths = '{}',
+		    completed_at = now(), updated_at = now()
+		WHERE id = $1
+	`, jobID)
+	if err != nil {
+		log.Printf("Ошибка обновления задачи удаления %s: %v", jobID, err)
+	}
+}
+
+// schedulePendingAccountDeletions повторяет удаление файлов для задач, не завершённых до перезапуска
+// или завершившихся ошибкой.
+func schedulePendingAccountDeletions() {
+	rows, err := db.Query(`SELECT id FROM account_deletions WHERE status IN ('pending', 'failed')`)
+	if err != nil {
+		log.Printf("Ошибка загрузки задач удаления аккаунтов: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var jobIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Ошибка чтения задачи удаления аккаунта: %v", err)
+			return
+		}
+		jobIDs = append(jobIDs, id)
+	}
+	if len(jobIDs) == 0 {
+		return
+	}
+
+	go func() {
+		for _, id := range jobIDs {
+			runAccountDeletion(id)
+		}
+	}()
+}
+
+// accountDeletionHandler (GET /api/account/deletions/{id}) возвращает статус удаления.
+// Авторизация не нужна: токен пользователя к этому моменту уже недействителен,
+// а id задачи знает только тот, кто удалял аккаунт.
+func accountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	var job AccountDeletion
+	var jobError sql.NullString
+	var createdAt, updatedAt time.Time
+	var completedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, status, image_count, voice_count, error, created_at, updated_at, completed_at
+		FROM account_deletions
+		WHERE id = $1
+	`, r.PathValue("id")).Scan(&job.ID, &job.Status, &job.ImageCount, &job.VoiceCount, &jobError, &createdAt, &updatedAt, &completedAt)
+	if err == sql.ErrNoRows {
+		writeError(w, "not_found", "Задача удаления не найдена", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка получения задачи удаления", nil, err)
+		return
+	}
+	job.Error = jobError.String
+	job.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	job.UpdatedAt = updatedAt.Format("2006-01-02T15:04:05Z")
+	if completedAt.Valid {
+		job.CompletedAt = completedAt.Time.Format("2006-01-02T15:04:05Z")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// accountExportHandler (GET /api/account/export) отдаёт zip со всеми данными пользователя:
+// account.json, purchases.json, memories.json и для каждого чата chat.json, chat.md, картинки и голосовые.
+// Архив пишется потоком, поэтому ошибки после начала ответа только логируются.
+func accountExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	account, err := loadAccountExport(userID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения данных аккаунта", nil, err)
+		return
+	}
+	purchases, err := loadAccountPurchases(userID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения покупок", nil, err)
+		return
+	}
+	memories, err := listMemories(userID, memoryMaxPerUser)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения памяти", nil, err)
+		return
+	}
+	chatIDs, err := getUserChatIDs(userID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения чатов", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="redflagged-export.zip"`)
+
+	zw := zip.NewWriter(w)
+	defer func() {
+		if err := zw.Close(); err != nil {
+			log.Printf("Ошибка завершения архива для %s: %v", userID, err)
+		}
+	}()
+
+	if err := writeZipJSON(zw, "account.json", account); err != nil {
+		log.Printf("Ошибка записи архива для %s: %v", userID, err)
+		return
+	}
+	if err := writeZipJSON(zw, "purchases.json", purchases); err != nil {
+		log.Printf("Ошибка записи архива для %s: %v", userID, err)
+		return
+	}
+	if err := writeZipJSON(zw, "memories.json", memories); err != nil {
+		log.Printf("Ошибка записи архива для %s: %v", userID, err)
+		return
+	}
+
+	for _, chatID := range chatIDs {
+		if r.Context().Err() != nil {
+			return
+		}
+		if err := writeChatToZip(zw, chatID); err != nil {
+			log.Printf("Ошибка записи чата %s в архив: %v", chatID, err)
+			return
+		}
+	}
+}
+
+func loadAccountExport(userID string) (AccountExport, error) {
+	account := AccountExport{
+		UserID:     userID,
+		ExportedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT u.created_at, COALESCE(c.count, 0), COALESCE(c.is_using_paid, false)
+		FROM users u
+		LEFT JOIN user_credits c ON c.user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&createdAt, &account.Credits, &account.IsUsingPaid)
+	if err != nil {
+		return account, fmt.Errorf("ошибка получения пользователя: %v", err)
+	}
+	account.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	return account, nil
+}
+
+func loadAccountPurchases(userID string) ([]AccountPurchase, error) {
+	rows, err := db.Query(`
+		SELECT transaction_id, product_id, created_at
+		FROM processed_transactions
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения покупок: %v", err)
+	}
+	defer rows.Close()
+
+	purchases := []AccountPurchase{}
+	for rows.Next() {
+		var p AccountPurchase
+		var createdAt time.Time
+		if err := rows.Scan(&p.TransactionID, &p.ProductID, &createdAt); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования покупки: %v", err)
+		}
+		p.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		purchases = append(purchases, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return purchases, nil
+}
+
+func getUserChatIDs(userID string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT id FROM chats WHERE user_id = $1 AND deleted_at IS NULL ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения чатов: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования чата: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return ids, nil
+}
+
+// writeChatToZip пишет активную ветку чата и все его файлы (включая другие ветки) в папку chats/<id>/.
+// Файлы, которые не удалось скачать, пропускаются.
+func writeChatToZip(zw *zip.Writer, chatID string) error {
+	export, err := loadChatExport(chatID, false)
+	if err != nil {
+		return err
+	}
+
+	dir := "chats/" + chatID + "/"
+	if err := writeZipJSON(zw, dir+"chat.json", export); err != nil {
+		return err
+	}
+	f, err := zw.Create(dir + "chat.md")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, renderChatMarkdown(export)); err != nil {
+		return err
+	}
+
+	var imagePaths, voicePaths []string
+	err = db.QueryRow(`
+		SELECT COALESCE((SELECT array_agg(DISTINCT p) FROM messages, unnest(image_paths) p WHERE chat_id = $1), '{}'),
+		       COALESCE((SELECT array_agg(DISTINCT p) FROM messages, unnest(voice_paths) p WHERE chat_id = $1), '{}')
+	`, chatID).Scan(pq.Array(&imagePaths), pq.Array(&voicePaths))
+	if err != nil {
+		return fmt.Errorf("ошибка получения файлов чата: %v", err)
+	}
+
+	for i, p := range imagePaths {
+		if err := writeStorageFileToZip(zw, fmt.Sprintf("%simages/%03d-%s", dir, i+1, path.Base(p)), p, getSignedURL); err != nil {
+			return err
+		}
+	}
+	for i, p := range voicePaths {
+		if err := writeStorageFileToZip(zw, fmt.Sprintf("%svoices/%03d-%s", dir, i+1, path.Base(p)), p, getVoiceSignedURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStorageFileToZip скачивает файл из хранилища в архив. Недоступный файл логируется
+// и пропускается; ошибка возвращается, только если запись в архив уже началась.
+func writeStorageFileToZip(zw *zip.Writer, name, storagePath string, sign func(string) (string, error)) error {
+	signedURL, err := sign(storagePath)
+	if err != nil {
+		log.Printf("Ошибка получения signed URL для экспорта %s: %v", storagePath, err)
+		return nil
+	}
+	resp, err := http.Get(signedURL)
+	if err != nil {
+		log.Printf("Ошибка скачивания %s для экспорта: %v", storagePath, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Ошибка скачивания %s для экспорта: статус %d", storagePath, resp.StatusCode)
+		return nil
+	}
+
+	// Картинки и голосовые уже сжаты, повторно их не жмём
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.LimitReader(resp.Body, accountExportMediaMaxSize))
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+// checkAdmin проверяет заголовок Authorization: Bearer $ADMIN_TOKEN.
+// Если токен не совпадает или не задан — пишет 401 и возвращает false.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" || r.Header.Get("Authorization") != "Bearer "+adminToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Println("Unauthorized admin attempt")
+		return false
+	}
+	return true
+}
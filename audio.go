@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxVoiceFileBytes = 25 << 20 // лимит Whisper API
+	maxVoiceDuration  = 10 * time.Minute
+	audioSniffLen     = 512
+	audioProbeTimeout = 10 * time.Second
+)
+
+var (
+	errVoiceTooLarge          = fmt.Errorf("голосовое сообщение больше %d МБ", maxVoiceFileBytes>>20)
+	errVoiceTooLong           = fmt.Errorf("голосовое сообщение длиннее %s", maxVoiceDuration)
+	errVoiceUnsupportedFormat = errors.New("неподдерживаемый формат голосового сообщения")
+)
+
+// audioFormat — формат, который принимает Whisper: имя файла определяет декодер на стороне OpenAI.
+type audioFormat struct {
+	Filename string
+	MIME     string
+}
+
+var (
+	audioFormatM4A  = audioFormat{Filename: "audio.m4a", MIME: "audio/mp4"}
+	audioFormatMP3  = audioFormat{Filename: "audio.mp3", MIME: "audio/mpeg"}
+	audioFormatWAV  = audioFormat{Filename: "audio.wav", MIME: "audio/wav"}
+	audioFormatOGG  = audioFormat{Filename: "audio.ogg", MIME: "audio/ogg"}
+	audioFormatWebM = audioFormat{Filename: "audio.webm", MIME: "audio/webm"}
+	audioFormatFLAC = audioFormat{Filename: "audio.flac", MIME: "audio/flac"}
+)
+
+// sniffAudioFormat определяет формат аудио по сигнатуре в начале файла.
+func sniffAudioFormat(header []byte) (audioFormat, bool) {
+	switch {
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return audioFormatM4A, true
+	// Синхрослово MPEG с ненулевым layer: у AAC ADTS (0xFFF1/0xFFF9) layer равен 00
+	case bytes.HasPrefix(header, []byte("ID3")),
+		len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 != 0:
+		return audioFormatMP3, true
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return audioFormatWAV, true
+	case bytes.HasPrefix(header, []byte("OggS")): // в том числе opus
+		return audioFormatOGG, true
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return audioFormatWebM, true
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return audioFormatFLAC, true
+	}
+	return audioFormat{}, false
+}
+
+// limitedAudioReader возвращает errVoiceTooLarge, как только прочитано больше n байт.
+type limitedAudioReader struct {
+	r    io.Reader
+	n    int64
+	read int64
+}
+
+func (l *limitedAudioReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.n {
+		return n, errVoiceTooLarge
+	}
+	return n, err
+}
+
+// probeAudioDuration узнаёт длительность аудио через ffprobe, если он установлен на сервере.
+func probeAudioDuration(audioURL string) (time.Duration, bool) {
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), audioProbeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, ffprobe,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		audioURL,
+	).Output()
+	if err != nil {
+		log.Printf("Ошибка ffprobe: %v", err)
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// transcodedAudio — поток mp3 из ffmpeg; Close дожидается завершения процесса.
+type transcodedAudio struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (t *transcodedAudio) Close() error {
+	t.ReadCloser.Close()
+	return t.cmd.Wait()
+}
+
+// transcodeAudio перекодирует неподдерживаемый Whisper формат в mp3 через ffmpeg.
+// Если ffmpeg не установлен, возвращает errVoiceUnsupportedFormat.
+func transcodeAudio(r io.Reader) (io.ReadCloser, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errVoiceUnsupportedFormat
+	}
+
+	cmd := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-vn", "-ac", "1", "-b:a", "64k",
+		"-f", "mp3", "pipe:1",
+	)
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запуска ffmpeg: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ошибка запуска ffmpeg: %v", err)
+	}
+	return &transcodedAudio{ReadCloser: out, cmd: cmd}, nil
+}
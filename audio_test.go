@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestSniffAudioFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   audioFormat
+		ok     bool
+	}{
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A "), audioFormatM4A, true},
+		{"mp3 id3", []byte("ID3\x04\x00"), audioFormatMP3, true},
+		{"mp3 frame sync", []byte{0xFF, 0xFB, 0x90, 0x00}, audioFormatMP3, true},
+		{"aac adts mpeg-4", []byte{0xFF, 0xF1, 0x50, 0x80}, audioFormat{}, false},
+		{"aac adts mpeg-2", []byte{0xFF, 0xF9, 0x50, 0x80}, audioFormat{}, false},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), audioFormatWAV, true},
+		{"ogg", []byte("OggS\x00\x02"), audioFormatOGG, true},
+		{"webm", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x01}, audioFormatWebM, true},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), audioFormatFLAC, true},
+		{"riff without wave", []byte("RIFF\x24\x00\x00\x00AVI "), audioFormat{}, false},
+		{"ftyp too short", []byte("\x00\x00\x00\x20fty"), audioFormat{}, false},
+		{"single 0xFF byte", []byte{0xFF}, audioFormat{}, false},
+		{"empty", nil, audioFormat{}, false},
+		{"text", []byte("hello world"), audioFormat{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := sniffAudioFormat(tt.header)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("sniffAudioFormat(%q) = %v, %v; want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
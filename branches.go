@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errMessageNotInChat = errors.New("сообщение не найдено в чате")
+
+// activateBranch делает messageID концом активной ветки чата. Новые сообщения будут его потомками.
+// superseded_at проставляется всем сообщениям вне новой ветки и снимается с сообщений на ней,
+// чтобы списки чатов и поиск учитывали только активную ветку без рекурсивных запросов.
+func activateBranch(chatID, messageID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND chat_id = $2)`, messageID, chatID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("ошибка проверки сообщения: %v", err)
+	}
+	if !exists {
+		return errMessageNotInChat
+	}
+
+	_, err = tx.Exec(`
+		WITH RECURSIVE path AS (
+			SELECT id, parent_id FROM messages WHERE id = $2
+			UNION ALL
+			SELECT m.id, m.parent_id FROM messages m JOIN path p ON m.id = p.parent_id
+		)
+		UPDATE messages
+		SET superseded_at = CASE
+			WHEN id IN (SELECT id FROM path) THEN NULL
+			ELSE COALESCE(superseded_at, now())
+		END
+		WHERE chat_id = $1
+	`, chatID, messageID)
+	if err != nil {
+		return fmt.Errorf("ошибка переключения ветки: %v", err)
+	}
+
+	_, err = tx.Exec(`UPDATE chats SET active_leaf_id = $2 WHERE id = $1`, chatID, messageID)
+	if err != nil {
+		return fmt.Errorf("ошибка переключения ветки: %v", err)
+	}
+	return tx.Commit()
+}
+
+// activeLeaf возвращает текущий конец активной ветки чата.
+func activeLeaf(chatID string) (string, error) {
+	var leafID sql.NullString
+	err := db.QueryRow(`SELECT active_leaf_id FROM chats WHERE id = $1`, chatID).Scan(&leafID)
+	if err != nil {
+		return "", fmt.Errorf("ошибка получения активной ветки: %v", err)
+	}
+	return leafID.String, nil
+}
+
+// restoreBranch возвращает активную ветку на leafID, если ход, переключивший ветку, не получил ответа.
+// Сохранённые в нём сообщения остаются соседней веткой. Ошибки только логируются.
+func restoreBranch(chatID, leafID string) {
+	if leafID == "" {
+		return
+	}
+	if err := activateBranch(chatID, leafID); err != nil {
+		log.Printf("Ошибка восстановления ветки чата %s: %v", chatID, err)
+	}
+}
+
+// branchesHandler (/api/chat/{id}/branches): GET возвращает ветки чата, POST переключает активную ветку.
+func branchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleBranchesGet(w, chatID)
+	case http.MethodPost:
+		handleBranchesPost(w, r, chatID)
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+// handleBranchesGet возвращает концы всех веток — сообщения без потомков, от новых к старым.
+func handleBranchesGet(w http.ResponseWriter, chatID string) {
+	rows, err := db.Query(`
+		SELECT m.id, m.role, m.content, m.created_at, m.id = c.active_leaf_id
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		WHERE m.chat_id = $1
+		  AND m.role NOT IN ('system', 'tool')
+		  AND NOT EXISTS (SELECT 1 FROM messages child WHERE child.parent_id = m.id)
+		ORDER BY m.created_at DESC
+	`, chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения веток", nil, err)
+		return
+	}
+	defer rows.Close()
+
+	branches := []ChatBranch{}
+	for rows.Next() {
+		var b ChatBranch
+		var content string
+		var createdAt time.Time
+		var active sql.NullBool
+		if err := rows.Scan(&b.LeafID, &b.Role, &content, &createdAt, &active); err != nil {
+			writeError(w, "db_error", "Ошибка чтения веток", nil, err)
+			return
+		}
+		b.Preview = truncateUTF8(content, chatPreviewMaxRune)
+		b.UpdatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		b.Active = active.Bool
+		branches = append(branches, b)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, "db_error", "Ошибка чтения веток", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(branches)
+}
+
+// handleBranchesPost переключает активную ветку на message_id (обычно leaf_id из списка веток).
+func handleBranchesPost(w http.ResponseWriter, r *http.Request, chatID string) {
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+	if req.MessageID == "" {
+		writeError(w, "missing_message_id", "Параметр message_id обязателен", nil, nil)
+		return
+	}
+
+	err := activateBranch(chatID, req.MessageID)
+	if errors.Is(err, errMessageNotInChat) {
+		writeError(w, "not_found", "Сообщение не найдено", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка переключения ветки", nil, err)
+		return
+	}
+
+	msgs, err := getChatMessages(chatID, false)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	signMessageThumbnails(msgs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/lib/pq"
 )
 
+const (
+	chatTitleMaxRunes        = 50
+	chatMessagesDefaultLimit = 50
+	chatMessagesMaxLimit     = 200
+	thumbnailSignWorkers     = 5
+	thumbnailSize            = 320
+
+	voiceTranscriptionWorkers  = 3
+	voiceTranscriptionAttempts = 3
+	voiceTranscriptionBackoff  = 500 * time.Millisecond
+)
+
+var errInvalidMessageCursor = errors.New("некорректный курсор сообщений")
+
 func chatHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("chatHandler: method=%s", r.Method)
 
@@ -31,19 +51,53 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleChatGet(w http.ResponseWriter, r *http.Request) {
-	chatID := r.URL.Query().Get("chat_id")
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	query := r.URL.Query()
+	chatID := query.Get("chat_id")
 	if chatID == "" {
 		log.Println("handleChatGet error: Параметр chat_id обязателен")
 		writeError(w, "missing_chat_id", "Параметр chat_id обязателен", nil, nil)
 		return
 	}
-	msgs, err := getChatMessages(chatID, false)
-	if err != nil {
+
+	limit := chatMessagesDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, "invalid_limit", "Некорректный параметр limit", nil, err)
+			return
+		}
+		if limit > chatMessagesMaxLimit {
+			limit = chatMessagesMaxLimit
+		}
+	}
+
+	// Ответ содержит подписанные ссылки на картинки, поэтому отдаём историю только владельцу
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	msgs, hasMore, err := getChatMessagesPage(chatID, query.Get("before"), query.Get("after"), limit)
+	if errors.Is(err, errInvalidMessageCursor) {
+		writeError(w, "invalid_cursor", "Некорректный параметр before/after", nil, err)
+		return
+	} else if err != nil {
 		log.Println("handleChatGet error: Ошибка получения сообщений")
 		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
 		return
 	}
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	signMessageThumbnails(msgs)
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Has-More", strconv.FormatBool(hasMore))
 	if err := json.NewEncoder(w).Encode(msgs); err != nil {
 		writeError(w, "json_encode_error", "Ошибка кодирования JSON", nil, err)
 	}
@@ -55,13 +109,18 @@ func handleChatPost(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
 		return
 	}
-	
+
 	// Validate UTF-8 encoding
 	if !utf8.ValidString(req.Prompt) {
 		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
 		return
 	}
-	
+
+	if req.ParentMessageID != "" && req.ChatID == "" {
+		writeError(w, "missing_chat_id", "parent_message_id требует chat_id", nil, nil)
+		return
+	}
+
 	log.Println("Получен POST-запрос:", req)
 
 	userID, err := getUserIDFromRequest(r)
@@ -70,30 +129,72 @@ func handleChatPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var count int
+	persona, ok := resolveRequestPersona(w, req, userID)
+	if !ok {
+		return
+	}
+
+	var isUsingPaid bool
 	err = db.QueryRow(`
-		SELECT count
+		SELECT is_using_paid
 		FROM user_credits
 		WHERE user_id = $1
-	`, userID).Scan(&count)
+	`, userID).Scan(&isUsingPaid)
 	if err != nil {
 		log.Println("handleChatPost error: Ошибка получения лимита сообщений")
 		writeError(w, "db_error", "Ошибка получения лимита сообщений", nil, err)
 		return
 	}
-	if count <= 0 {
-		writeError(w, "no_messages", "У вас закончились все доступные сообщения", nil, nil)
-		return
+
+	// Готовые результаты асинхронной транскрипции проверяем до создания чата
+	var jobVoiceResults []VoiceTranscription
+	if len(req.TranscriptionJobIDs) > 0 {
+		results, jobs, err := finishedTranscriptions(userID, req.TranscriptionJobIDs)
+		if errors.Is(err, errTranscriptionsFailed) {
+			writeError(w, "voice_transcription_error", "Ошибка транскрипции голосового сообщения", results, err)
+			return
+		}
+		if err != nil {
+			writeError(w, "transcription_not_ready", "Транскрипция голосового сообщения ещё не готова", jobs, err)
+			return
+		}
+		jobVoiceResults = results
 	}
 
+	// Цена хода зависит от вложений и объёма контекста; кредиты списываются атомарно до запросов к OpenAI
+	quote, voiceDurations, err := quoteChatRequest(persona, req, jobVoiceResults)
+	if errors.Is(err, errMessageNotInChat) {
+		writeError(w, "not_found", "Сообщение не найдено", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	debited, err := debitCredits(userID, quote.Credits)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка обновления счётчика сообщений", nil, err)
+		return
+	}
+	if !debited {
+		writeError(w, "no_messages", "У вас закончились все доступные сообщения", quote, nil)
+		return
+	}
+	// Если ход не дошёл до сохранения ответа, списанные кредиты возвращаются
+	completed := false
+	defer func() {
+		if !completed {
+			refundCredits(userID, quote.Credits)
+		}
+	}()
 
 	chatID := req.ChatID
+	var title string // заполняется только для нового чата
 	if chatID == "" {
 		// Новый чат
-		title := req.Prompt
+		title = req.Prompt
 		if title == "" {
 			// Если нет текста, но есть голосовые сообщения или изображения
-			if len(req.VoicePaths) > 0 {
+			if len(req.VoicePaths) > 0 || len(jobVoiceResults) > 0 {
 				title = "Voice recorded"
 			} else if len(req.ImagePaths) > 0 {
 				title = "Attached image"
@@ -102,284 +203,239 @@ func handleChatPost(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// Безопасное обрезание UTF-8 строки
-		if utf8.RuneCountInString(title) > 50 {
-			title = truncateUTF8(title, 50)
+		if utf8.RuneCountInString(title) > chatTitleMaxRunes {
+			title = truncateUTF8(title, chatTitleMaxRunes)
+		}
+		// Если для персоны идёт эксперимент, вариант подменяет её промпт и модель; модель тарифа
+		// применяется последней, чтобы вариант не поднял бесплатного пользователя до платной модели
+		var experimentID, variantID string
+		if exp, variant, ok := experiments.assign(persona.ID, userID); ok {
+			experimentID, variantID = exp.ID, variant.ID
+			persona = variant.apply(persona)
+		}
+		persona = persona.forTier(userTier(isUsingPaid))
+		systemPrompt, ok := prompts.current(persona.PromptName)
+		if !ok {
+			writeError(w, "prompt_unavailable", "Системный промпт не настроен", nil, nil)
+			return
 		}
-		newChatID, err := createChat(userID, title)
+		newChatID, err := createChat(userID, title, systemPrompt.ID, persona.ID, experimentID, variantID)
 		if err != nil {
 			writeError(w, "db_error", "Ошибка создания чата", nil, err)
 			return
 		}
 		chatID = newChatID
 
-		systemBytes, err := os.ReadFile(".prompt")
-		if err != nil {
-			writeError(w, "file_read_error", "Не удалось прочитать .prompt файл", nil, err)
+		// Текст промпта берётся из реестра по prompt_version_id; пустое system-сообщение — корень дерева сообщений
+		if _, err := saveMessage(chatID, "system", "", nil); err != nil {
+			writeError(w, "db_error", "Ошибка сохранения system-сообщения", nil, err)
 			return
 		}
-		systemContent := string(systemBytes)
+		// Память о прошлых чатах фиксируется снимком: модель видит её во всех ходах этого чата
+		if err := snapshotChatMemory(chatID, userID); err != nil {
+			log.Printf("Ошибка подстановки памяти в чат %s: %v", chatID, err)
+		}
+	}
 
-		if err := saveMessage(chatID, "system", systemContent, nil); err != nil {
-			writeError(w, "db_error", "Ошибка сохранения system-сообщения", nil, err)
+	// Ответвление: новый ход продолжает указанное сообщение, а не конец активной ветки.
+	// Если ответ не будет сохранён, активной снова становится прежняя ветка
+	if req.ParentMessageID != "" {
+		prevLeaf, err := activeLeaf(chatID)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка создания ветки", nil, err)
 			return
 		}
-	} else {
-		var ownerID string
-		err := db.QueryRow(`SELECT user_id FROM chats WHERE id = $1`, chatID).Scan(&ownerID)
-		if err == sql.ErrNoRows {
-			log.Println("handleChatPost error: Чат не найден")
-			writeError(w, "not_found", "Чат не найден", nil, nil)
+		err = activateBranch(chatID, req.ParentMessageID)
+		if errors.Is(err, errMessageNotInChat) {
+			writeError(w, "not_found", "Сообщение не найдено", nil, nil)
 			return
 		} else if err != nil {
-			log.Println("handleChatPost error: Ошибка проверки чата")
-			writeError(w, "db_error", "Ошибка проверки чата", nil, err)
+			writeError(w, "db_error", "Ошибка создания ветки", nil, err)
 			return
 		}
-		if ownerID != userID {
-			log.Println("handleChatPost error: Этот чат не принадлежит user_id")
-			writeError(w, "forbidden", "Этот чат не принадлежит user_id", nil, nil)
-			return
+		defer func() {
+			if !completed {
+				restoreBranch(chatID, prevLeaf)
+			}
+		}()
+	}
+
+	if req.Language != "" {
+		if err := setChatSearchLanguage(chatID, req.Language); err != nil {
+			log.Printf("Ошибка сохранения языка чата %s: %v", chatID, err)
 		}
 	}
 
 	// Транскрибируем голосовые сообщения один раз для текущего запроса
-	var currentVoiceTranscription string
+	var voiceResults []VoiceTranscription
 	if len(req.VoicePaths) > 0 {
-		transcription, err := transcribeVoiceFiles(req.VoicePaths)
+		voiceResults, err = transcribeVoiceFiles(req.VoicePaths, req.Language, voiceDurations)
 		if err != nil {
 			log.Println("handleChatPost error: Ошибка транскрипции голоса")
-			writeError(w, "voice_transcription_error", "Ошибка транскрипции голосового сообщения", nil, err)
+			writeError(w, "voice_transcription_error", "Ошибка транскрипции голосового сообщения", voiceResults, err)
 			return
 		}
-		currentVoiceTranscription = transcription
-	}
-
-	if err := saveMessageWithTranscription(chatID, "user", req.Prompt, req.ImagePaths, req.VoicePaths, currentVoiceTranscription); err != nil {
-		writeError(w, "db_error", "Ошибка сохранения сообщения пользователя", nil, err)
-		return
-	}
-
-	messages, err := getChatMessages(chatID, true)
-	if err != nil {
-		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
-		return
-	}
-
-	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-	if openaiAPIKey == "" {
-		log.Println("handleChatPost error: Сервер не настроен (отсутствует API ключ)")
-		writeError(w, "openai_not_configured", "Сервер не настроен (отсутствует API ключ)", nil, nil)
-		return
 	}
-
-	var visionContents []VisionContentItem
-	for _, msg := range messages {
-		if strings.HasPrefix(msg.Content, "image:") {
-			path := strings.TrimSpace(strings.TrimPrefix(msg.Content, "image:"))
-			signedURL, err := getSignedURL(path)
-			if err != nil {
-				log.Println("handleChatPost error: Ошибка получения signed URL из истории")
-				log.Println("Ошибка получения signed URL из истории:", err)
-				continue
-			}
-			visionContents = append(visionContents, VisionContentItem{
-				Type: "image_url",
-				ImageURL: &VisionImageURL{
-					URL:    signedURL,
-					Detail: "auto",
-				},
-			})
-		} else {
-			visionContents = append(visionContents, VisionContentItem{
-				Type: "text",
-				Text: msg.Content,
-			})
-		}
-
-		// Добавляем кэшированные транскрипции голосовых сообщений из истории
-		if msg.VoiceTranscription != "" {
-			visionContents = append(visionContents, VisionContentItem{
-				Type: "text",
-				Text: msg.VoiceTranscription,
-			})
+	// Расход на Whisper и распознавание скриншотов относится к сообщению пользователя
+	var userUsage usageStats
+	userUsage.addTranscriptions(voiceResults)
+	voicePaths := req.VoicePaths
+	for _, res := range jobVoiceResults {
+		voicePaths = append(voicePaths, res.Path)
+	}
+	voiceResults = append(voiceResults, jobVoiceResults...)
+	currentVoiceTranscription := joinVoiceTranscriptions(voiceResults)
+
+	// Длительность части голосовых могла быть неизвестна при расчёте цены: доплачиваем
+	// надбавку по длительности из транскрипции или отказываем, если кредитов не хватает
+	var transcribedSeconds float64
+	for _, res := range voiceResults {
+		if res.Status == "ok" {
+			transcribedSeconds += res.Duration
 		}
 	}
-
-	// Добавляем текущий prompt
-	visionContents = append(visionContents, VisionContentItem{
-		Type: "text",
-		Text: req.Prompt,
-	})
-
-	// Добавляем картинки из текущего запроса
-	for _, path := range req.ImagePaths {
-		signedURL, err := getSignedURL(path)
+	if repriced := quote.withAudio(transcribedSeconds); repriced.Credits > quote.Credits {
+		debited, err := debitCredits(userID, repriced.Credits-quote.Credits)
 		if err != nil {
-			log.Println("handleChatPost error: Ошибка получения signed URL")
-			writeError(w, "supabase_signed_url_error", "Ошибка получения signed URL", nil, err)
+			recordUsage(userID, userUsage)
+			writeError(w, "db_error", "Ошибка обновления счётчика сообщений", nil, err)
 			return
 		}
-		visionContents = append(visionContents, VisionContentItem{
-			Type: "image_url",
-			ImageURL: &VisionImageURL{
-				URL:    signedURL,
-				Detail: "auto",
-			},
-		})
+		if !debited {
+			recordUsage(userID, userUsage)
+			writeError(w, "no_messages", "У вас закончились все доступные сообщения", repriced, nil)
+			return
+		}
+		quote = repriced
 	}
 
-	// Добавляем транскрипцию текущих голосовых сообщений
-	if currentVoiceTranscription != "" {
-		visionContents = append(visionContents, VisionContentItem{
-			Type: "text",
-			Text: currentVoiceTranscription,
-		})
+	// Распознаём скриншоты один раз, чтобы в следующих ходах отправлять текст вместо картинок
+	var currentImageTranscripts []ScreenshotTranscript
+	if len(req.ImagePaths) > 0 {
+		var ocrUsage usageStats
+		currentImageTranscripts, ocrUsage = extractScreenshotTranscripts(req.ImagePaths)
+		userUsage.merge(ocrUsage)
 	}
 
-	var model string = "gpt-4o"
-
-	visionReq := VisionRequest{
-		Model: model,
-		Messages: []VisionMessage{{
-			Role:    "user",
-			Content: visionContents,
-		}},
-	}
-
-	jsonData, err := json.Marshal(visionReq)
+	userMessageID, err := saveMessageWithTranscription(chatID, "user", req.Prompt, req.ImagePaths, voicePaths, voiceResults, currentImageTranscripts)
 	if err != nil {
-		log.Println("handleChatPost error: Ошибка формирования JSON для OpenAI")
-		writeError(w, "json_encode_error", "Ошибка формирования JSON для OpenAI", nil, err)
+		// Транскрипция и распознавание уже оплачены OpenAI, хоть сообщение и не сохранилось
+		recordUsage(userID, userUsage)
+		writeError(w, "db_error", "Ошибка сохранения сообщения пользователя", nil, err)
 		return
 	}
+	recordMessageUsage(userMessageID, userID, userUsage)
 
-	apiReq, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	messages, err := loadChatHistory(chatID)
 	if err != nil {
-		log.Println("handleChatPost error: Ошибка создания запроса к OpenAI")
-		writeError(w, "openai_error", "Ошибка создания запроса к OpenAI", nil, err)
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
 		return
 	}
-	apiReq.Header.Set("Content-Type", "application/json")
-	apiReq.Header.Set("Authorization", "Bearer "+openaiAPIKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(apiReq)
-	if err != nil {
-		writeError(w, "openai_error", "Ошибка выполнения запроса к OpenAI", nil, err)
+	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
+	if openaiAPIKey == "" {
+		log.Println("handleChatPost error: Сервер не настроен (отсутствует API ключ)")
+		writeError(w, "openai_not_configured", "Сервер не настроен (отсутствует API ключ)", nil, nil)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Последнее сообщение ветки — только что сохранённый ход вместе с расшифровкой скриншотов и голоса
+	visionContents, err := buildTurnContents(messages)
 	if err != nil {
-		writeError(w, "openai_error", "Ошибка чтения ответа от OpenAI", nil, err)
+		log.Println("handleChatPost error: Ошибка получения signed URL")
+		writeError(w, "supabase_signed_url_error", "Ошибка получения signed URL", nil, err)
 		return
 	}
 
-	var openaiResp OpenAIResponse
-	if err := json.Unmarshal(body, &openaiResp); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(body)
-		return
+	// Инструменты доступны только в обычном режиме: структурированный ответ запрашивается в JSON
+	var assistantMsg string
+	var verdict *Verdict
+	var toolSteps []Message
+	meta := replyMeta{Model: persona.Model}
+	// Если ответ не сохранится, расход на уже выполненные запросы учитывается без привязки к сообщению
+	defer func() {
+		if !completed {
+			recordUsage(userID, meta.Usage)
+		}
+	}()
+	if req.Structured {
+		assistantMsg, verdict, err = requestStructuredReply(persona, visionContents, &meta)
+	} else {
+		assistantMsg, toolSteps, err = requestReplyWithTools(persona, visionContents, toolContext{UserID: userID, ChatID: chatID}, &meta)
 	}
-
-	if len(openaiResp.Choices) == 0 {
-		writeError(w, "openai_error", "OpenAI не вернул ответа", nil, nil)
+	if err != nil {
+		writeError(w, "openai_error", "Ошибка запроса к OpenAI", nil, err)
 		return
 	}
-
-	assistantMsg := openaiResp.Choices[0].Message.Content
 	log.Printf("%s", assistantMsg)
-	if err := saveMessage(chatID, "assistant", assistantMsg, nil); err != nil {
+	assistantMessageID, err := saveAssistantMessage(chatID, toolSteps, assistantMsg, verdict, meta)
+	if err != nil {
 		writeError(w, "db_error", "Ошибка сохранения сообщения ассистента", nil, err)
 		return
 	}
+	completed = true
+	recordMessageUsage(assistantMessageID, userID, meta.Usage)
 
-	// Обновляем счётчик сообщений в user_credits
-	_, err = db.Exec(`UPDATE user_credits SET count = count - 1 WHERE user_id = $1`, userID)
-	if err != nil {
-		log.Println("handleChatPost error: Ошибка обновления счётчика сообщений")
-		writeError(w, "db_error", "Ошибка обновления счётчика сообщений", nil, err)
-		return
+	// Для нового чата в фоне заменяем временное название на сгенерированное моделью
+	if req.ChatID == "" {
+		go generateChatTitle(userID, chatID, title, titleSourceText(req.Prompt, currentVoiceTranscription, currentImageTranscripts), assistantMsg)
 	}
+	go extractMemories(userID, chatID, titleSourceText(req.Prompt, currentVoiceTranscription, currentImageTranscripts), assistantMsg)
+
 	respData := ChatResponse{
-		ChatID:   chatID,
-		Response: assistantMsg,
+		ChatID:       chatID,
+		MessageID:    assistantMessageID,
+		Response:     assistantMsg,
+		Verdict:      verdict,
+		VoiceResults: voiceResults,
+		Credits:      quote.Credits,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(respData)
 }
 
+// getSignedURL возвращает подписанную ссылку на картинку из основного бакета.
 func getSignedURL(path string) (string, error) {
-	baseURL := os.Getenv("SUPABASE_URL") + "/storage/v1"
-	secret := os.Getenv("SUPABASE_SERVICE_ROLE")
-	bucket := os.Getenv("SUPABASE_BUCKET_NAME")
-
-	if baseURL == "" || secret == "" || bucket == "" {
-		return "", fmt.Errorf("не заданы переменные окружения SUPABASE_URL / SERVICE_ROLE / BUCKET_NAME")
-	}
-
-	requestBody := map[string]interface{}{
-		"expiresIn": 3600, // 1 час
-	}
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", err
-	}
-
-	url := fmt.Sprintf("%s/object/sign/%s/%s", baseURL, bucket, strings.TrimPrefix(path, "/"))
-
-	fmt.Println(url)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+secret)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("supabase вернул %d: %s", resp.StatusCode, string(body))
-	}
+	return signStorageObject(os.Getenv("SUPABASE_BUCKET_NAME"), path, nil)
+}
 
-	var response struct {
-		SignedURL string `json:"signedURL"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", err
-	}
+// getVoiceSignedURL возвращает подписанную ссылку на голосовое сообщение.
+func getVoiceSignedURL(path string) (string, error) {
+	return signStorageObject(voiceBucketName, path, nil)
+}
 
-	return baseURL + response.SignedURL, nil
+// getSignedThumbnailURL возвращает подписанную ссылку на уменьшенную копию картинки (Supabase image transformation).
+func getSignedThumbnailURL(path string) (string, error) {
+	return signStorageObject(os.Getenv("SUPABASE_BUCKET_NAME"), path, map[string]interface{}{
+		"width":  thumbnailSize,
+		"height": thumbnailSize,
+		"resize": "contain",
+	})
 }
 
-func getVoiceSignedURL(path string) (string, error) {
-	baseURL := os.Getenv("SUPABASE_URL") + "/storage/v1"
+// signStorageObject подписывает объект бакета Supabase Storage на час. transform (может быть nil)
+// передаётся как параметры image transformation.
+func signStorageObject(bucket, path string, transform map[string]interface{}) (string, error) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
 	secret := os.Getenv("SUPABASE_SERVICE_ROLE")
-	voiceBucket := "redflagged-voices" // Hardcoded voice bucket name
 
-	if baseURL == "" || secret == "" {
-		return "", fmt.Errorf("не заданы переменные окружения SUPABASE_URL / SERVICE_ROLE")
+	if supabaseURL == "" || secret == "" || bucket == "" {
+		return "", fmt.Errorf("не заданы переменные окружения SUPABASE_URL / SERVICE_ROLE / BUCKET_NAME")
 	}
+	baseURL := supabaseURL + "/storage/v1"
 
 	requestBody := map[string]interface{}{
 		"expiresIn": 3600, // 1 час
 	}
+	if transform != nil {
+		requestBody["transform"] = transform
+	}
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return "", err
 	}
 
-	url := fmt.Sprintf("%s/object/sign/%s/%s", baseURL, voiceBucket, strings.TrimPrefix(path, "/"))
-
-	fmt.Printf("Voice signed URL: %s\n", url)
+	url := fmt.Sprintf("%s/object/sign/%s/%s", baseURL, bucket, strings.TrimPrefix(path, "/"))
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -410,51 +466,144 @@ func getVoiceSignedURL(path string) (string, error) {
 	return baseURL + response.SignedURL, nil
 }
 
-// saveMessage сохраняет сообщение в таблице messages (для системных сообщений без голоса).
-func saveMessage(chatID, role, content string, imagePaths []string, voicePaths ...[]string) error {
+// signMessageThumbnails заполняет ThumbnailURLs для картинок сообщений, подписывая их параллельно.
+// Картинки, которые не удалось подписать, получают пустую ссылку, чтобы индексы совпадали с image_paths.
+func signMessageThumbnails(msgs []Message) {
+	sem := make(chan struct{}, thumbnailSignWorkers)
+	var wg sync.WaitGroup
+	for i := range msgs {
+		if len(msgs[i].ImagePaths) == 0 {
+			continue
+		}
+		msgs[i].ThumbnailURLs = make([]string, len(msgs[i].ImagePaths))
+		for j, path := range msgs[i].ImagePaths {
+			wg.Add(1)
+			go func(urls []string, j int, path string) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				signedURL, err := getSignedThumbnailURL(path)
+				if err != nil {
+					log.Printf("Ошибка получения thumbnail URL для %s: %v", path, err)
+					return
+				}
+				urls[j] = signedURL
+			}(msgs[i].ThumbnailURLs, j, path)
+		}
+	}
+	wg.Wait()
+}
+
+// saveMessage сохраняет сообщение в таблице messages (для системных сообщений без голоса) и возвращает его id.
+func saveMessage(chatID, role, content string, imagePaths []string, voicePaths ...[]string) (string, error) {
 	var voices []string
 	if len(voicePaths) > 0 {
 		voices = voicePaths[0]
 	}
-	return saveMessageWithTranscription(chatID, role, content, imagePaths, voices, "")
+	return saveMessageWithTranscription(chatID, role, content, imagePaths, voices, nil, nil)
 }
 
-// saveMessageWithTranscription сохраняет сообщение с уже готовой транскрипцией.
-func saveMessageWithTranscription(chatID, role, content string, imagePaths, voicePaths []string, voiceTranscription string) error {
-	_, err := db.Exec(`
-        INSERT INTO messages (chat_id, role, content, image_paths, voice_paths, voice_transcription)
-        VALUES ($1, $2, $3, $4, $5, $6)
-    `, chatID, role, content, pq.Array(imagePaths), pq.Array(voicePaths), voiceTranscription)
+// saveMessageWithTranscription сохраняет сообщение с уже готовыми транскрипциями голоса и скриншотов.
+// Сообщение становится потомком текущего конца активной ветки чата и само становится её концом.
+func saveMessageWithTranscription(chatID, role, content string, imagePaths, voicePaths []string, voiceTranscriptions []VoiceTranscription, imageTranscripts []ScreenshotTranscript) (string, error) {
+	var voiceTranscription interface{}
+	if len(voiceTranscriptions) > 0 {
+		data, err := json.Marshal(voiceTranscriptions)
+		if err != nil {
+			return "", fmt.Errorf("ошибка кодирования транскрипций голоса: %v", err)
+		}
+		voiceTranscription = string(data)
+	}
+
+	var imageTranscription interface{}
+	if len(imageTranscripts) > 0 {
+		data, err := json.Marshal(imageTranscripts)
+		if err != nil {
+			return "", fmt.Errorf("ошибка кодирования расшифровки скриншотов: %v", err)
+		}
+		imageTranscription = string(data)
+	}
+
+	// search_vector строится с конфигурацией языка чата (см. setChatSearchLanguage)
+	var messageID string
+	err := db.QueryRow(`
+        WITH inserted AS (
+            INSERT INTO messages (chat_id, parent_id, role, content, image_paths, voice_paths, voice_transcriptions, image_transcription, search_config, search_vector)
+            VALUES ($1, (SELECT active_leaf_id FROM chats WHERE id = $1), $2, $3, $4, $5, $6, $7,
+                    (SELECT search_config FROM chats WHERE id = $1),
+                    to_tsvector((SELECT search_config FROM chats WHERE id = $1), $3 || ' ' || $8::text))
+            RETURNING id
+        )
+        UPDATE chats SET active_leaf_id = (SELECT id FROM inserted)
+        WHERE id = $1
+        RETURNING active_leaf_id
+    `, chatID, role, content, pq.Array(imagePaths), pq.Array(voicePaths), voiceTranscription, imageTranscription, joinVoiceTranscriptions(voiceTranscriptions)).Scan(&messageID)
 	if err != nil {
-		return fmt.Errorf("ошибка сохранения сообщения: %v", err)
+		return "", fmt.Errorf("ошибка сохранения сообщения: %v", err)
 	}
-	return nil
+	return messageID, nil
 }
 
-// createChat создаёт новый чат для пользователя.
-func createChat(userID, title string) (string, error) {
+// createChat создаёт новый чат для пользователя с указанной персоной и версией её системного промпта.
+// experimentID и variantID пустые, если чат не попал в эксперимент.
+func createChat(userID, title, promptVersionID, personaID, experimentID, variantID string) (string, error) {
 	var chatID string
 	err := db.QueryRow(`
-        INSERT INTO chats (user_id, title)
-        VALUES ($1, $2)
+        INSERT INTO chats (user_id, title, prompt_version_id, persona_id, experiment_id, variant_id)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))
         RETURNING id
-    `, userID, title).Scan(&chatID)
+    `, userID, title, promptVersionID, personaID, experimentID, variantID).Scan(&chatID)
 	if err != nil {
 		return "", fmt.Errorf("ошибка создания чата: %v", err)
 	}
 	return chatID, nil
 }
 
-// getChatMessages возвращает все сообщения из чата, отсортированные по времени (по возрастанию). Если includeSystem == false, исключает system-сообщения.
+// activePathCTE выбирает id сообщений активной ветки чата $1: от active_leaf_id вверх по parent_id.
+const activePathCTE = `
+        WITH RECURSIVE active_path AS (
+            SELECT m.id, m.parent_id
+            FROM messages m
+            JOIN chats c ON c.active_leaf_id = m.id
+            WHERE c.id = $1
+            UNION ALL
+            SELECT m.id, m.parent_id
+            FROM messages m
+            JOIN active_path p ON m.id = p.parent_id
+        )`
+
+const messageColumns = `id, parent_id, role, content, image_paths, voice_paths, voice_transcription, voice_transcriptions, image_transcription, created_at, edited_at, verdict, tool_call`
+
+// checkChatOwner проверяет, что чат существует, не удалён и принадлежит пользователю.
+// Если нет — пишет ошибку в ответ и возвращает false.
+func checkChatOwner(w http.ResponseWriter, chatID, userID string) bool {
+	var ownerID string
+	err := db.QueryRow(`SELECT user_id FROM chats WHERE id = $1 AND deleted_at IS NULL`, chatID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		writeError(w, "not_found", "Чат не найден", nil, nil)
+		return false
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка проверки чата", nil, err)
+		return false
+	}
+	if ownerID != userID {
+		writeError(w, "forbidden", "Этот чат не принадлежит user_id", nil, nil)
+		return false
+	}
+	return true
+}
+
+// getChatMessages возвращает сообщения активной ветки чата, отсортированные по времени (по возрастанию). Если includeSystem == false, исключает system-сообщения.
 func getChatMessages(chatID string, includeSystem bool) ([]Message, error) {
-	query := `
-        SELECT role, content, image_paths, voice_paths, voice_transcription, created_at
+	query := activePathCTE + `
+        SELECT ` + messageColumns + `
         FROM messages
-        WHERE chat_id = $1`
+        WHERE chat_id = $1 AND id IN (SELECT id FROM active_path)`
 	if !includeSystem {
-		query += " AND role != 'system'"
+		query += " AND role NOT IN ('system', 'tool')"
 	}
-	query += " ORDER BY created_at ASC"
+	query += " ORDER BY created_at ASC, id ASC"
 
 	rows, err := db.Query(query, chatID)
 	if err != nil {
@@ -462,25 +611,149 @@ func getChatMessages(chatID string, includeSystem bool) ([]Message, error) {
 	}
 	defer rows.Close()
 
+	return scanMessages(rows, includeSystem)
+}
+
+// getChatMessagesPage возвращает до limit сообщений активной ветки чата (без system) по возрастанию времени.
+// before/after — id сообщения (позиция (created_at, id), надёжный курсор) или время в RFC3339
+// с долями секунды, как в Message.Timestamp; без after возвращаются самые новые сообщения перед before.
+// Второе значение сообщает, есть ли ещё сообщения в направлении выборки.
+func getChatMessagesPage(chatID, before, after string, limit int) ([]Message, bool, error) {
+	query := activePathCTE + `
+        SELECT ` + messageColumns + `
+        FROM messages
+        WHERE chat_id = $1 AND role NOT IN ('system', 'tool') AND id IN (SELECT id FROM active_path)`
+	args := []interface{}{chatID}
+
+	for _, bound := range []struct {
+		cursor string
+		op     string
+	}{{before, "<"}, {after, ">"}} {
+		if bound.cursor == "" {
+			continue
+		}
+		t, id, err := resolveMessageCursor(chatID, bound.cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		if id != "" {
+			args = append(args, t, id)
+			query += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d::uuid)", bound.op, len(args)-1, len(args))
+		} else {
+			args = append(args, t)
+			query += fmt.Sprintf(" AND created_at %s $%d", bound.op, len(args))
+		}
+	}
+
+	// Без after идём от новых к старым, чтобы первой страницей были последние сообщения
+	descending := after == ""
+	if descending {
+		query += " ORDER BY created_at DESC, id DESC"
+	} else {
+		query += " ORDER BY created_at ASC, id ASC"
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("ошибка запроса сообщений: %v", err)
+	}
+	defer rows.Close()
+
+	msgs, err := scanMessages(rows, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(msgs) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+	if descending {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+	return msgs, hasMore, nil
+}
+
+// resolveMessageCursor превращает курсор в позицию (created_at, id). Для курсора-времени id пустой.
+func resolveMessageCursor(chatID, cursor string) (time.Time, string, error) {
+	if _, err := uuid.Parse(cursor); err == nil {
+		var t time.Time
+		err := db.QueryRow(`SELECT created_at FROM messages WHERE id = $1 AND chat_id = $2`, cursor, chatID).Scan(&t)
+		if err == sql.ErrNoRows {
+			return time.Time{}, "", errInvalidMessageCursor
+		} else if err != nil {
+			return time.Time{}, "", fmt.Errorf("ошибка поиска сообщения курсора: %v", err)
+		}
+		return t, cursor, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidMessageCursor
+	}
+	return t, "", nil
+}
+
+// scanMessages читает строки, выбранные по messageColumns.
+func scanMessages(rows *sql.Rows, includeSystem bool) ([]Message, error) {
 	var msgs []Message
 	for rows.Next() {
 		var m Message
 		var voiceTranscription sql.NullString
-		var timestamp sql.NullTime
-		err := rows.Scan(&m.Role, &m.Content, pq.Array(&m.ImagePaths), pq.Array(&m.VoicePaths), &voiceTranscription, &timestamp)
+		var voiceTranscriptions sql.NullString
+		var imageTranscription sql.NullString
+		var parentID sql.NullString
+		var timestamp, editedAt sql.NullTime
+		var verdict, toolCall sql.NullString
+		err := rows.Scan(&m.ID, &parentID, &m.Role, &m.Content, pq.Array(&m.ImagePaths), pq.Array(&m.VoicePaths), &voiceTranscription, &voiceTranscriptions, &imageTranscription, &timestamp, &editedAt, &verdict, &toolCall)
 		if err != nil {
 			return nil, fmt.Errorf("ошибка сканирования сообщения: %v", err)
 		}
-		
+
 		// Only include voice transcription for internal processing (includeSystem=true)
 		if voiceTranscription.Valid && includeSystem {
 			m.VoiceTranscription = voiceTranscription.String
 		}
-		
+		// Транскрипции по файлам с таймкодами отдаются и клиенту, чтобы показать их под голосовым сообщением
+		if voiceTranscriptions.Valid {
+			if err := json.Unmarshal([]byte(voiceTranscriptions.String), &m.VoiceTranscriptions); err != nil {
+				log.Printf("Ошибка разбора транскрипций голоса: %v", err)
+			}
+		}
+		if imageTranscription.Valid && includeSystem {
+			if err := json.Unmarshal([]byte(imageTranscription.String), &m.ImageTranscripts); err != nil {
+				log.Printf("Ошибка разбора расшифровки скриншотов: %v", err)
+			}
+		}
+
+		// Полная точность в UTC: клиенты передают timestamp обратно как курсор before/after
 		if timestamp.Valid {
-			m.Timestamp = timestamp.Time.Format("2006-01-02T15:04:05Z")
+			m.Timestamp = timestamp.Time.UTC().Format(time.RFC3339Nano)
 		}
-		
+		m.ParentID = parentID.String
+		if editedAt.Valid {
+			m.EditedAt = editedAt.Time.Format("2006-01-02T15:04:05Z")
+		}
+		if verdict.Valid {
+			m.Verdict = &Verdict{}
+			if err := json.Unmarshal([]byte(verdict.String), m.Verdict); err != nil {
+				log.Printf("Ошибка разбора оценки рисков: %v", err)
+				m.Verdict = nil
+			}
+		}
+		if toolCall.Valid {
+			var call ToolCall
+			if err := json.Unmarshal([]byte(toolCall.String), &call); err != nil {
+				log.Printf("Ошибка разбора вызова инструмента: %v", err)
+			} else {
+				m.ToolCalls = []ToolCall{call}
+			}
+		}
+
 		msgs = append(msgs, m)
 	}
 	if err := rows.Err(); err != nil {
@@ -489,91 +762,162 @@ func getChatMessages(chatID string, includeSystem bool) ([]Message, error) {
 	return msgs, nil
 }
 
-// transcribeVoiceFiles transcribes multiple voice files and returns their combined text
-func transcribeVoiceFiles(voicePaths []string) (string, error) {
+// transcribeVoiceFiles параллельно транскрибирует голосовые файлы и возвращает результат по каждому файлу
+// в исходном порядке. durations — длительности, уже измеренные при расчёте цены (может быть nil).
+// Ошибка возвращается, только если не удалось транскрибировать ни один файл.
+func transcribeVoiceFiles(voicePaths []string, language string, durations map[string]time.Duration) ([]VoiceTranscription, error) {
 	if len(voicePaths) == 0 {
-		return "", nil
+		return nil, nil
 	}
 
-	var transcriptions []string
-	for _, path := range voicePaths {
-		signedURL, err := getVoiceSignedURL(path)
-		if err != nil {
-			log.Printf("Ошибка получения voice signed URL для голоса %s: %v", path, err)
-			continue
-		}
+	results := make([]VoiceTranscription, len(voicePaths))
+	sem := make(chan struct{}, voiceTranscriptionWorkers)
+	var wg sync.WaitGroup
+	for i, path := range voicePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
 
-		transcription, err := transcribeVoiceFromURL(signedURL)
-		if err != nil {
-			log.Printf("Ошибка транскрипции голоса %s: %v", path, err)
-			continue
+			result, err := transcribeVoiceWithRetry(path, language, durations[path])
+			if err != nil {
+				log.Printf("Ошибка транскрипции голоса %s: %v", path, err)
+				results[i] = VoiceTranscription{Path: path, Status: "failed", Error: err.Error()}
+				return
+			}
+			result.Path = path
+			result.Status = "ok"
+			results[i] = result
+		}(i, path)
+	}
+	wg.Wait()
+
+	for _, res := range results {
+		if res.Status == "ok" {
+			return results, nil
 		}
+	}
+	return results, fmt.Errorf("не удалось транскрибировать ни одного голосового сообщения")
+}
 
-		if transcription != "" {
-			transcriptions = append(transcriptions, transcription)
+// transcribeVoiceWithRetry транскрибирует один файл, повторяя попытку при временных сбоях Whisper.
+// duration — уже известная длительность файла или 0, если её надо узнать через ffprobe.
+func transcribeVoiceWithRetry(path, language string, duration time.Duration) (VoiceTranscription, error) {
+	signedURL, err := getVoiceSignedURL(path)
+	if err != nil {
+		return VoiceTranscription{}, fmt.Errorf("ошибка получения voice signed URL: %v", err)
+	}
+
+	backoff := voiceTranscriptionBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := transcribeVoiceFromURL(signedURL, language, duration)
+		if err == nil {
+			return result, nil
+		}
+		if attempt >= voiceTranscriptionAttempts || !isRetryableError(err) {
+			return VoiceTranscription{}, err
 		}
+		log.Printf("Повтор транскрипции голоса %s (попытка %d): %v", path, attempt+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	if len(transcriptions) == 0 {
-		return "", fmt.Errorf("не удалось транскрибировать ни одного голосового сообщения")
+// joinVoiceTranscriptions склеивает успешные транскрипции в текст для контекста модели.
+func joinVoiceTranscriptions(results []VoiceTranscription) string {
+	var texts []string
+	for _, res := range results {
+		if res.Status == "ok" && res.Text != "" {
+			texts = append(texts, res.Text)
+		}
 	}
+	return strings.Join(texts, "\n")
+}
 
-	return strings.Join(transcriptions, "\n"), nil
+// messageVoiceText возвращает текст голосовых сообщений из истории.
+// Старые сообщения хранят одну склеенную строку в voice_transcription.
+func messageVoiceText(msg Message) string {
+	if len(msg.VoiceTranscriptions) > 0 {
+		return joinVoiceTranscriptions(msg.VoiceTranscriptions)
+	}
+	return msg.VoiceTranscription
 }
 
-// transcribeVoiceFromURL downloads and transcribes audio from URL
-func transcribeVoiceFromURL(audioURL string) (string, error) {
+// transcribeVoiceFromURL скачивает аудио и потоком передаёт его в Whisper,
+// определяя формат по содержимому и проверяя размер и длительность.
+// Если duration равна 0, длительность узнаётся через ffprobe.
+// Возвращает текст вместе с сегментами и таймкодами; Path и Status заполняет вызывающий.
+func transcribeVoiceFromURL(audioURL, language string, duration time.Duration) (VoiceTranscription, error) {
 	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
 	if openaiAPIKey == "" {
-		return "", fmt.Errorf("сервер не настроен (отсутствует API ключ)")
+		return VoiceTranscription{}, fmt.Errorf("сервер не настроен (отсутствует API ключ)")
+	}
+
+	if duration == 0 {
+		duration, _ = probeAudioDuration(audioURL)
+	}
+	if duration > maxVoiceDuration {
+		return VoiceTranscription{}, errVoiceTooLong
 	}
 
 	// Скачиваем аудиофайл
 	resp, err := http.Get(audioURL)
 	if err != nil {
-		return "", fmt.Errorf("ошибка скачивания аудио: %v", err)
+		return VoiceTranscription{}, fmt.Errorf("ошибка скачивания аудио: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("ошибка скачивания аудио, статус: %d", resp.StatusCode)
-	}
-
-	audioData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("ошибка чтения аудиоданных: %v", err)
-	}
-
-	// Создаем multipart form для отправки в OpenAI
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
-
-	// Добавляем модель
-	err = writer.WriteField("model", "whisper-1")
-	if err != nil {
-		return "", fmt.Errorf("ошибка создания поля model: %v", err)
+		return VoiceTranscription{}, fmt.Errorf("ошибка скачивания аудио, статус: %d", resp.StatusCode)
 	}
-
-	// Добавляем аудиофайл
-	fileWriter, err := writer.CreateFormFile("file", "audio.m4a")
-	if err != nil {
-		return "", fmt.Errorf("ошибка создания поля file: %v", err)
+	if resp.ContentLength > maxVoiceFileBytes {
+		return VoiceTranscription{}, errVoiceTooLarge
 	}
 
-	_, err = fileWriter.Write(audioData)
-	if err != nil {
-		return "", fmt.Errorf("ошибка записи аудиоданных: %v", err)
+	audio := bufio.NewReaderSize(&limitedAudioReader{r: resp.Body, n: maxVoiceFileBytes}, audioSniffLen)
+	header, err := audio.Peek(audioSniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return VoiceTranscription{}, fmt.Errorf("ошибка чтения аудиоданных: %v", err)
 	}
 
-	err = writer.Close()
-	if err != nil {
-		return "", fmt.Errorf("ошибка закрытия writer: %v", err)
-	}
+	var audioData io.Reader = audio
+	var transcoded io.ReadCloser
+	format, ok := sniffAudioFormat(header)
+	if !ok {
+		transcoded, err = transcodeAudio(audio)
+		if err != nil {
+			return VoiceTranscription{}, err
+		}
+		audioData = transcoded
+		format = audioFormatMP3
+	}
+
+	// Пишем multipart form прямо в тело запроса, не держа файл в памяти
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	writeErr := make(chan error, 1)
+	go func() {
+		err := writeTranscriptionForm(writer, format, normalizeLanguageHint(language), audioData)
+		if transcoded != nil {
+			if cerr := transcoded.Close(); err == nil && cerr != nil {
+				if errors.Is(cerr, errVoiceTooLarge) {
+					err = errVoiceTooLarge
+				} else {
+					err = fmt.Errorf("ошибка перекодирования аудио: %v", cerr)
+				}
+			}
+		}
+		bodyWriter.CloseWithError(err)
+		writeErr <- err
+	}()
 
 	// Создаем HTTP запрос
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", &requestBody)
+	req, err := http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", bodyReader)
 	if err != nil {
-		return "", fmt.Errorf("ошибка создания запроса: %v", err)
+		bodyReader.Close()
+		<-writeErr
+		return VoiceTranscription{}, fmt.Errorf("ошибка создания запроса: %v", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
@@ -582,33 +926,104 @@ func transcribeVoiceFromURL(audioURL string) (string, error) {
 	// Выполняем запрос
 	client := &http.Client{}
 	resp2, err := client.Do(req)
+	bodyReader.Close()
+	if werr := <-writeErr; werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		if resp2 != nil {
+			resp2.Body.Close()
+		}
+		return VoiceTranscription{}, werr
+	}
 	if err != nil {
-		return "", fmt.Errorf("ошибка выполнения запроса к OpenAI: %v", err)
+		return VoiceTranscription{}, fmt.Errorf("ошибка выполнения запроса к OpenAI: %w", err)
 	}
 	defer resp2.Body.Close()
 
 	// Читаем ответ
 	body, err := io.ReadAll(resp2.Body)
 	if err != nil {
-		return "", fmt.Errorf("ошибка чтения ответа: %v", err)
+		return VoiceTranscription{}, fmt.Errorf("ошибка чтения ответа: %v", err)
 	}
 
 	if resp2.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("OpenAI вернул ошибку %d: %s", resp2.StatusCode, string(body))
+		return VoiceTranscription{}, &openAIStatusError{StatusCode: resp2.StatusCode, Body: string(body)}
 	}
 
-	// Парсим JSON ответ
+	// Парсим verbose_json ответ
 	var transcriptionResponse struct {
-		Text string `json:"text"`
+		Text     string         `json:"text"`
+		Language string         `json:"language"`
+		Duration float64        `json:"duration"`
+		Segments []VoiceSegment `json:"segments"`
 	}
 
 	err = json.Unmarshal(body, &transcriptionResponse)
 	if err != nil {
-		return "", fmt.Errorf("ошибка парсинга JSON ответа: %v", err)
+		return VoiceTranscription{}, fmt.Errorf("ошибка парсинга JSON ответа: %v", err)
 	}
 
 	log.Printf("Транскрипция успешно выполнена: %s", transcriptionResponse.Text)
-	return transcriptionResponse.Text, nil
+	return VoiceTranscription{
+		Text:     transcriptionResponse.Text,
+		Language: transcriptionResponse.Language,
+		Duration: transcriptionResponse.Duration,
+		Segments: transcriptionResponse.Segments,
+	}, nil
+}
+
+// writeTranscriptionForm пишет поля запроса к Whisper и сам аудиофайл.
+func writeTranscriptionForm(writer *multipart.Writer, format audioFormat, language string, audioData io.Reader) error {
+	// Добавляем модель
+	if err := writer.WriteField("model", "whisper-1"); err != nil {
+		return fmt.Errorf("ошибка создания поля model: %v", err)
+	}
+
+	// verbose_json возвращает сегменты с таймкодами
+	if err := writer.WriteField("response_format", "verbose_json"); err != nil {
+		return fmt.Errorf("ошибка создания поля response_format: %v", err)
+	}
+	if err := writer.WriteField("timestamp_granularities[]", "segment"); err != nil {
+		return fmt.Errorf("ошибка создания поля timestamp_granularities: %v", err)
+	}
+
+	if language != "" {
+		if err := writer.WriteField("language", language); err != nil {
+			return fmt.Errorf("ошибка создания поля language: %v", err)
+		}
+	}
+
+	// Добавляем аудиофайл
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, format.Filename))
+	partHeader.Set("Content-Type", format.MIME)
+	fileWriter, err := writer.CreatePart(partHeader)
+	if err != nil {
+		return fmt.Errorf("ошибка создания поля file: %v", err)
+	}
+
+	if _, err := io.Copy(fileWriter, audioData); err != nil {
+		if errors.Is(err, errVoiceTooLarge) {
+			return errVoiceTooLarge
+		}
+		return fmt.Errorf("ошибка записи аудиоданных: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("ошибка закрытия writer: %v", err)
+	}
+	return nil
+}
+
+// normalizeLanguageHint приводит язык клиента ("ru", "ru-RU", "pt_BR") к коду ISO-639-1,
+// который принимает Whisper. Некорректные значения отбрасываются.
+func normalizeLanguageHint(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	if len(language) != 2 || language[0] < 'a' || language[0] > 'z' || language[1] < 'a' || language[1] > 'z' {
+		return ""
+	}
+	return language
 }
 
 // truncateUTF8 safely truncates a UTF-8 string to the specified number of runes
@@ -616,7 +1031,7 @@ func truncateUTF8(s string, maxRunes int) string {
 	if utf8.RuneCountInString(s) <= maxRunes {
 		return s
 	}
-	
+
 	runes := []rune(s)
 	if len(runes) > maxRunes {
 		runes = runes[:maxRunes]
@@ -2,10 +2,28 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	chatsDefaultLimit  = 50
+	chatsMaxLimit      = 100
+	chatPreviewMaxRune = 120
 )
 
+// chatsHandler возвращает чаты пользователя: сначала закреплённые, затем по последней активности.
+// Параметры: limit, cursor (из заголовка X-Next-Cursor предыдущей страницы), has_images, has_voice,
+// archived=true — только архивные чаты (по умолчанию архивные скрыты).
 func chatsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
@@ -18,32 +36,242 @@ func chatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query := r.URL.Query()
+	limit := chatsDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Некорректный параметр limit", http.StatusBadRequest)
+			return
+		}
+		if limit > chatsMaxLimit {
+			limit = chatsMaxLimit
+		}
+	}
+
+	var cursorPinned sql.NullBool
+	var cursorTime sql.NullTime
+	var cursorID sql.NullString
+	if v := query.Get("cursor"); v != "" {
+		pinned, t, id, err := decodeChatsCursor(v)
+		if err != nil {
+			http.Error(w, "Некорректный параметр cursor", http.StatusBadRequest)
+			return
+		}
+		cursorPinned = sql.NullBool{Bool: pinned, Valid: true}
+		cursorTime = sql.NullTime{Time: t, Valid: true}
+		cursorID = sql.NullString{String: id, Valid: true}
+	}
+	onlyImages := query.Get("has_images") == "true"
+	onlyVoice := query.Get("has_voice") == "true"
+	archived := query.Get("archived") == "true"
+
 	rows, err := db.Query(`
-		SELECT id, title
-		FROM chats
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`, userID)
+		SELECT c.id, c.title, c.pinned, c.archived, COALESCE(c.persona_id, $9), c.created_at,
+		       COALESCE(s.last_activity, c.created_at) AS updated_at,
+		       COALESCE(s.message_count, 0),
+		       COALESCE(s.has_images, false),
+		       COALESCE(s.has_voice, false),
+		       la.content
+		FROM chats c
+		LEFT JOIN LATERAL (
+			SELECT max(m.created_at) AS last_activity,
+			       count(*) AS message_count,
+			       bool_or(cardinality(m.image_paths) > 0) AS has_images,
+			       bool_or(cardinality(m.voice_paths) > 0) AS has_voice
+			FROM messages m
+			WHERE m.chat_id = c.id AND m.role NOT IN ('system', 'tool') AND m.superseded_at IS NULL
+		) s ON true
+		LEFT JOIN LATERAL (
+			SELECT m.content
+			FROM messages m
+			WHERE m.chat_id = c.id AND m.role = 'assistant' AND m.superseded_at IS NULL
+			ORDER BY m.created_at DESC
+			LIMIT 1
+		) la ON true
+		WHERE c.user_id = $1
+		  AND c.deleted_at IS NULL
+		  AND c.archived = $7
+		  AND ($2::timestamptz IS NULL OR (c.pinned, COALESCE(s.last_activity, c.created_at), c.id) < ($8::boolean, $2::timestamptz, $3::uuid))
+		  AND (NOT $4 OR COALESCE(s.has_images, false))
+		  AND (NOT $5 OR COALESCE(s.has_voice, false))
+		ORDER BY c.pinned DESC, updated_at DESC, c.id DESC
+		LIMIT $6
+	`, userID, cursorTime, cursorID, onlyImages, onlyVoice, limit+1, archived, cursorPinned, defaultPersonaID)
 	if err != nil {
 		http.Error(w, "Ошибка запроса чатов: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var chats []ChatSummary
+	chats := []ChatSummary{}
+	var lastActivity []time.Time
 	for rows.Next() {
 		var cs ChatSummary
-		var title sql.NullString
-		if err := rows.Scan(&cs.ID, &title); err != nil {
+		var title, preview sql.NullString
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&cs.ID, &title, &cs.Pinned, &cs.Archived, &cs.Persona, &createdAt, &updatedAt, &cs.MessageCount, &cs.HasImages, &cs.HasVoice, &preview); err != nil {
 			http.Error(w, "Ошибка чтения данных: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 		if title.Valid {
 			cs.Title = title.String
 		}
+		if preview.Valid {
+			cs.LastMessage = truncateUTF8(preview.String, chatPreviewMaxRune)
+		}
+		cs.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		cs.UpdatedAt = updatedAt.Format("2006-01-02T15:04:05Z")
 		chats = append(chats, cs)
+		lastActivity = append(lastActivity, updatedAt)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Ошибка чтения данных: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Запрашиваем на одну запись больше, чтобы понять, есть ли следующая страница
+	if len(chats) > limit {
+		chats = chats[:limit]
+		last := chats[limit-1]
+		w.Header().Set("X-Next-Cursor", encodeChatsCursor(last.Pinned, lastActivity[limit-1], last.ID))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(chats)
 }
+
+// encodeChatsCursor кодирует позицию последнего чата страницы: закреплён ли он, время активности и id.
+func encodeChatsCursor(pinned bool, t time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatBool(pinned) + "|" + t.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeChatsCursor(cursor string) (bool, time.Time, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return false, time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(data), "|", 3)
+	if len(parts) != 3 {
+		return false, time.Time{}, "", fmt.Errorf("некорректный курсор")
+	}
+	pinned, err := strconv.ParseBool(parts[0])
+	if err != nil {
+		return false, time.Time{}, "", err
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return false, time.Time{}, "", err
+	}
+	if _, err := uuid.Parse(parts[2]); err != nil {
+		return false, time.Time{}, "", err
+	}
+	return pinned, t, parts[2], nil
+}
+
+// chatItemHandler обслуживает /api/chats/{id}: PATCH меняет title/pinned/archived, DELETE удаляет чат.
+func chatItemHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPatch:
+		handleChatPatch(w, r)
+	case http.MethodDelete:
+		handleChatDelete(w, r)
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+func handleChatPatch(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	var req struct {
+		Title    *string `json:"title"`
+		Pinned   *bool   `json:"pinned"`
+		Archived *bool   `json:"archived"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+
+	var title sql.NullString
+	if req.Title != nil {
+		t := strings.TrimSpace(*req.Title)
+		if t == "" {
+			writeError(w, "invalid_title", "Название чата не может быть пустым", nil, nil)
+			return
+		}
+		if !utf8.ValidString(t) {
+			writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+			return
+		}
+		title = sql.NullString{String: truncateUTF8(t, chatTitleMaxRunes), Valid: true}
+	}
+	var pinned, archived sql.NullBool
+	if req.Pinned != nil {
+		pinned = sql.NullBool{Bool: *req.Pinned, Valid: true}
+	}
+	if req.Archived != nil {
+		archived = sql.NullBool{Bool: *req.Archived, Valid: true}
+	}
+
+	var resp struct {
+		ID       string `json:"id"`
+		Title    string `json:"title"`
+		Pinned   bool   `json:"pinned"`
+		Archived bool   `json:"archived"`
+	}
+	err = db.QueryRow(`
+		UPDATE chats
+		SET title = COALESCE($2, title),
+		    pinned = COALESCE($3, pinned),
+		    archived = COALESCE($4, archived)
+		WHERE id = $1
+		RETURNING id, COALESCE(title, ''), pinned, archived
+	`, chatID, title, pinned, archived).Scan(&resp.ID, &resp.Title, &resp.Pinned, &resp.Archived)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка обновления чата", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleChatDelete помечает чат удалённым и в фоне удаляет его картинки и голосовые файлы из хранилища.
+func handleChatDelete(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	_, err = db.Exec(`UPDATE chats SET deleted_at = now() WHERE id = $1`, chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка удаления чата", nil, err)
+		return
+	}
+
+	// Если сервер перезапустится до очистки, её доделает schedulePendingChatPurges
+	go func() {
+		if err := purgeChatMedia(chatID); err != nil {
+			log.Printf("Ошибка очистки чата %s: %v", chatID, err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestChatsCursorRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 10, 20, 30, 123456789, time.FixedZone("MSK", 3*60*60))
+	tests := []struct {
+		name   string
+		pinned bool
+		t      time.Time
+		id     string
+	}{
+		{"pinned", true, ts, "0b6c6f0e-8f0a-4a57-9d36-2c3f3e0f1a2b"},
+		{"not pinned", false, ts, "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{"zero time", false, time.Time{}, "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinned, got, id, err := decodeChatsCursor(encodeChatsCursor(tt.pinned, tt.t, tt.id))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if pinned != tt.pinned || !got.Equal(tt.t) || id != tt.id {
+				t.Errorf("got %v, %v, %q; want %v, %v, %q", pinned, got, id, tt.pinned, tt.t, tt.id)
+			}
+		})
+	}
+}
+
+func TestDecodeChatsCursorMalformed(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"empty", ""},
+		{"two parts", enc("true|2024-03-05T10:20:30Z")},
+		{"bad bool", enc("yes|2024-03-05T10:20:30Z|f47ac10b-58cc-4372-a567-0e02b2c3d479")},
+		{"bad time", enc("true|yesterday|f47ac10b-58cc-4372-a567-0e02b2c3d479")},
+		{"bad uuid", enc("true|2024-03-05T10:20:30Z|1 OR 1=1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := decodeChatsCursor(tt.cursor); err == nil {
+				t.Errorf("decodeChatsCursor(%q) returned no error", tt.cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// debitCredits атомарно списывает кредиты пользователя.
+// Возвращает false, если кредитов недостаточно.
+func debitCredits(userID string, amount int) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE user_credits
+		SET count = count - $2, updated_at = now()
+		WHERE user_id = $1 AND count >= $2
+	`, userID, amount)
+	if err != nil {
+		return false, fmt.Errorf("ошибка списания кредитов: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ошибка списания кредитов: %v", err)
+	}
+	return n > 0, nil
+}
+
+// refundCredits возвращает кредиты, списанные за запрос, который не удалось выполнить.
+func refundCredits(userID string, amount int) {
+	_, err := db.Exec(`
+		UPDATE user_credits
+		SET count = count + $2, updated_at = now()
+		WHERE user_id = $1
+	`, userID, amount)
+	if err != nil {
+		log.Printf("Ошибка возврата %d кредитов пользователю %s: %v", amount, userID, err)
+	}
+}
@@ -1,25 +1,53 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type ChatRequest struct {
 	UserID     string   `json:"user_id"` // теперь клиент передаёт user_id
 	ChatID     string   `json:"chat_id"` // если пустой, создаётся новый чат
 	Prompt     string   `json:"prompt"`
 	ImagePaths []string `json:"image_paths"`
 	VoicePaths []string `json:"voice_paths"`
+	Language   string   `json:"language"` // ISO-639-1 подсказка для транскрипции голоса, например "ru"
+	// TranscriptionJobIDs — готовые задачи асинхронной транскрипции (/api/transcriptions),
+	// результаты которых прикрепляются к сообщению вместо синхронной транскрипции VoicePaths.
+	TranscriptionJobIDs []string `json:"transcription_job_ids"`
+	// ParentMessageID — сообщение, от которого ответвляется новый ход; пусто — продолжение активной ветки.
+	ParentMessageID string `json:"parent_message_id"`
+	// Persona — режим анализа из /api/personas; учитывается только при создании чата.
+	Persona string `json:"persona"`
+	// Structured — вернуть вместе с ответом оценку рисков (ChatResponse.Verdict).
+	Structured bool `json:"structured"`
 }
 
 type ChatResponse struct {
-	ChatID   string `json:"chat_id"`
-	Response string `json:"response"`
+	ChatID       string               `json:"chat_id"`
+	MessageID    string               `json:"message_id,omitempty"` // id ответа ассистента, например для оценки
+	Response     string               `json:"response"`
+	Verdict      *Verdict             `json:"verdict,omitempty"` // только при structured: true
+	VoiceResults []VoiceTranscription `json:"voice_results,omitempty"`
+	Credits      int                  `json:"credits_charged"`
 }
 
 type Message struct {
-	Role              string   `json:"role"`
-	Content           string   `json:"content"`
-	ImagePaths        []string `json:"image_paths"`
-	VoicePaths        []string `json:"voice_paths"`
-	VoiceTranscription string   `json:"voice_transcription,omitempty"`
-	Timestamp         string   `json:"timestamp"`
+	ID                  string                 `json:"id,omitempty"`
+	ParentID            string                 `json:"parent_id,omitempty"`
+	Role                string                 `json:"role"`
+	Content             string                 `json:"content"`
+	ImagePaths          []string               `json:"image_paths"`
+	ThumbnailURLs       []string               `json:"thumbnail_urls,omitempty"` // подписанные ссылки на превью, по индексу image_paths
+	VoicePaths          []string               `json:"voice_paths"`
+	VoiceTranscription  string                 `json:"voice_transcription,omitempty"`
+	VoiceTranscriptions []VoiceTranscription   `json:"voice_transcriptions,omitempty"`
+	ImageTranscripts    []ScreenshotTranscript `json:"image_transcripts,omitempty"`
+	Timestamp           string                 `json:"timestamp"`
+	EditedAt            string                 `json:"edited_at,omitempty"`
+	Verdict             *Verdict               `json:"verdict,omitempty"` // только у ответов, полученных в структурированном режиме
+	// ToolCalls — вызовы инструментов в ответе OpenAI; у сохранённых сообщений с ролью tool — один выполненный вызов.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type OpenAIRequest struct {
@@ -32,22 +60,53 @@ type Choice struct {
 }
 
 type OpenAIResponse struct {
-	Choices []Choice `json:"choices"`
+	Model   string       `json:"model"`
+	Choices []Choice     `json:"choices"`
+	Usage   *OpenAIUsage `json:"usage,omitempty"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
 }
 
 type ChatSummary struct {
-	ID    string `json:"id"`
-	Title string `json:"title,omitempty"`
+	ID           string `json:"id"`
+	Title        string `json:"title,omitempty"`
+	Pinned       bool   `json:"pinned"`
+	Archived     bool   `json:"archived"`
+	Persona      string `json:"persona,omitempty"`
+	LastMessage  string `json:"last_message_preview,omitempty"` // начало последнего ответа ассистента
+	MessageCount int    `json:"message_count"`
+	HasImages    bool   `json:"has_images"`
+	HasVoice     bool   `json:"has_voice"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"` // время последнего сообщения
 }
 
 type VisionRequest struct {
-	Model    string          `json:"model"`
-	Messages []VisionMessage `json:"messages"`
+	Model          string           `json:"model"`
+	Messages       []VisionMessage  `json:"messages"`
+	Temperature    *float64         `json:"temperature,omitempty"`
+	MaxTokens      int              `json:"max_tokens,omitempty"`
+	ResponseFormat *ResponseFormat  `json:"response_format,omitempty"`
+	Tools          []ToolDefinition `json:"tools,omitempty"`
+	ToolChoice     string           `json:"tool_choice,omitempty"` // "none" запрещает вызовы инструментов
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"` // "text" или "json_object"
 }
 
 type VisionMessage struct {
-	Role    string              `json:"role"`
-	Content []VisionContentItem `json:"content"`
+	Role       string              `json:"role"`
+	Content    []VisionContentItem `json:"content"`
+	ToolCalls  []ToolCall          `json:"tool_calls,omitempty"`   // у assistant, запросившего инструменты
+	ToolCallID string              `json:"tool_call_id,omitempty"` // у tool — на какой вызов это ответ
 }
 
 type VisionContentItem struct {
@@ -60,3 +119,292 @@ type VisionImageURL struct {
 	URL    string `json:"url"`
 	Detail string `json:"detail"` // "low", "high", "auto"
 }
+
+// ScreenshotLine — одна реплика, распознанная на скриншоте переписки.
+type ScreenshotLine struct {
+	Speaker   string `json:"speaker"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// ScreenshotTranscript — структурированная расшифровка одного скриншота.
+type ScreenshotTranscript struct {
+	Path   string           `json:"path"`
+	Number int              `json:"number,omitempty"` // номер скриншота в сообщении, начиная с 1
+	Lines  []ScreenshotLine `json:"lines"`
+}
+
+// VoiceTranscription — результат транскрипции одного голосового файла.
+type VoiceTranscription struct {
+	Path     string         `json:"path"`
+	Status   string         `json:"status"` // "ok" или "failed"
+	Text     string         `json:"text,omitempty"`
+	Language string         `json:"language,omitempty"`
+	Duration float64        `json:"duration,omitempty"` // в секундах
+	Segments []VoiceSegment `json:"segments,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// VoiceSegment — фрагмент транскрипции с таймкодами в секундах от начала записи.
+type VoiceSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// TranscriptionJob — задача асинхронной транскрипции одного голосового файла.
+type TranscriptionJob struct {
+	ID        string              `json:"id"`
+	Status    string              `json:"status"` // "pending", "processing", "done" или "failed"
+	VoicePath string              `json:"voice_path"`
+	Result    *VoiceTranscription `json:"result,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	CreatedAt string              `json:"created_at"`
+	UpdatedAt string              `json:"updated_at"`
+}
+
+type SearchMatch struct {
+	MessageID string `json:"message_id"`
+	Role      string `json:"role"`
+	Snippet   string `json:"snippet"` // HTML-экранирован, совпадения обёрнуты в <b></b>
+	Timestamp string `json:"timestamp"`
+}
+
+type SearchResult struct {
+	ChatID  string        `json:"chat_id"`
+	Title   string        `json:"title,omitempty"`
+	Matches []SearchMatch `json:"matches"`
+}
+
+// ChatBranch — конец одной из веток чата.
+type ChatBranch struct {
+	LeafID    string `json:"leaf_id"`
+	Role      string `json:"role"`
+	Preview   string `json:"preview"`
+	UpdatedAt string `json:"updated_at"`
+	Active    bool   `json:"active"`
+}
+
+// ChatExport — чат в виде, пригодном для сохранения или пересылки (без system-промпта).
+type ChatExport struct {
+	ChatID     string            `json:"chat_id,omitempty"`
+	Title      string            `json:"title"`
+	CreatedAt  string            `json:"created_at"`
+	ExportedAt string            `json:"exported_at"`
+	Messages   []ExportedMessage `json:"messages"`
+}
+
+type ExportedMessage struct {
+	ID                 string   `json:"id"`
+	Role               string   `json:"role"`
+	Content            string   `json:"content"`
+	Timestamp          string   `json:"timestamp"`
+	VoiceTranscription string   `json:"voice_transcription,omitempty"`
+	ImageURLs          []string `json:"image_urls,omitempty"` // подписанные ссылки, действуют 1 час
+}
+
+// ChatShare — публичная ссылка на чат только для чтения.
+type ChatShare struct {
+	ID           string `json:"id"`
+	Token        string `json:"token"`
+	URL          string `json:"url"`
+	RedactImages bool   `json:"redact_images"`
+	CreatedAt    string `json:"created_at"`
+	ExpiresAt    string `json:"expires_at"`
+	RevokedAt    string `json:"revoked_at,omitempty"`
+	Active       bool   `json:"active"`
+}
+
+// AccountDeletion — задача удаления файлов удалённого аккаунта.
+type AccountDeletion struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"` // "pending", "done" или "failed"
+	ImageCount  int    `json:"image_count"`
+	VoiceCount  int    `json:"voice_count"`
+	Error       string `json:"error,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at,omitempty"`
+	CompletedAt string `json:"completed_at,omitempty"`
+}
+
+type AccountExport struct {
+	UserID      string `json:"user_id"`
+	CreatedAt   string `json:"created_at"`
+	ExportedAt  string `json:"exported_at"`
+	Credits     int    `json:"credits"`
+	IsUsingPaid bool   `json:"is_using_paid"`
+}
+
+type AccountPurchase struct {
+	TransactionID string `json:"transaction_id"`
+	ProductID     string `json:"product_id"`
+	CreatedAt     string `json:"created_at"`
+}
+
+// PromptVersion — опубликованная версия промпта. Версии неизменяемы, новая публикуется с version+1.
+type PromptVersion struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Persona — режим анализа: свой системный промпт, модель и цена сообщения.
+type Persona struct {
+	ID                 string                  `json:"id"`
+	Name               string                  `json:"name"`
+	Description        string                  `json:"description,omitempty"`
+	PromptName         string                  `json:"-"` // имя промпта в реестре prompts
+	Model              string                  `json:"model"`
+	Temperature        *float64                `json:"temperature,omitempty"`
+	MaxTokens          int                     `json:"-"`                   // 0 — без ограничения
+	FallbackModel      string                  `json:"-"`                   // используется, если основная модель вернула 429/5xx
+	Tiers              map[string]PersonaModel `json:"-"`                   // настройки модели для тарифов "free" и "paid"
+	AllowedAttachments []string                `json:"allowed_attachments"` // "image", "voice"
+	CreditCost         int                     `json:"credit_cost"`
+}
+
+// PersonaModel — настройки модели персоны для одного тарифа. Пустые поля не меняют настройки персоны.
+type PersonaModel struct {
+	Model         string
+	FallbackModel string
+	MaxTokens     int
+	Temperature   *float64
+}
+
+// Experiment — A/B-эксперимент над промптом и моделью. PersonaID пустой — эксперимент для всех персон.
+type Experiment struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	PersonaID string              `json:"persona_id,omitempty"`
+	Status    string              `json:"status"` // "running" или "stopped"
+	Variants  []ExperimentVariant `json:"variants"`
+	CreatedAt string              `json:"created_at"`
+
+	created time.Time // для выбора самого старого эксперимента: CreatedAt округлён до секунд
+}
+
+// ExperimentVariant переопределяет поля персоны; пустые поля не меняются.
+type ExperimentVariant struct {
+	ID          string   `json:"id"`
+	PromptName  string   `json:"prompt_name,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Weight      int      `json:"weight"`
+}
+
+type ExperimentVariantStats struct {
+	VariantID      string  `json:"variant_id"`
+	Chats          int     `json:"chats"`
+	FollowUpChats  int     `json:"follow_up_chats"`
+	FollowUpRate   float64 `json:"follow_up_rate"`
+	ThumbsUp       int     `json:"thumbs_up"`
+	ThumbsDown     int     `json:"thumbs_down"`
+	ThumbsUpRate   float64 `json:"thumbs_up_rate"`
+	Users          int     `json:"users"`
+	ConvertedUsers int     `json:"converted_users"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+type ExperimentReport struct {
+	Experiment
+	Results []ExperimentVariantStats `json:"results"`
+}
+
+// FeedbackRecord — оценка ответа ассистента с контекстом, в котором ответ был получен.
+type FeedbackRecord struct {
+	MessageID        string `json:"message_id"`
+	ChatID           string `json:"chat_id"`
+	Rating           string `json:"rating"` // "up" или "down"
+	Reason           string `json:"reason,omitempty"`
+	Comment          string `json:"comment,omitempty"`
+	Model            string `json:"model,omitempty"` // пусто для ответов, сохранённых до учёта модели
+	PromptVersionID  string `json:"prompt_version_id,omitempty"`
+	PromptName       string `json:"prompt_name,omitempty"`
+	PromptVersion    int    `json:"prompt_version,omitempty"`
+	PersonaID        string `json:"persona_id,omitempty"`
+	ExperimentID     string `json:"experiment_id,omitempty"`
+	VariantID        string `json:"variant_id,omitempty"`
+	UserMessage      string `json:"user_message"`
+	AssistantMessage string `json:"assistant_message"`
+	RatedAt          string `json:"rated_at"`
+}
+
+// Verdict — оценка рисков переписки для карточки в приложении.
+type Verdict struct {
+	RiskScore int           `json:"risk_score"` // 0–100
+	Summary   string        `json:"summary"`
+	Flags     []VerdictFlag `json:"flags"`
+}
+
+type VerdictFlag struct {
+	Category    string `json:"category"`
+	Severity    string `json:"severity"` // "low", "medium" или "high"
+	Evidence    string `json:"evidence"` // цитата из переписки
+	Explanation string `json:"explanation"`
+}
+
+// ToolDefinition — описание инструмента для OpenAI (function calling).
+type ToolDefinition struct {
+	Type     string                 `json:"type"` // "function"
+	Function ToolFunctionDefinition `json:"function"`
+}
+
+type ToolFunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolCall — вызов инструмента, запрошенный моделью.
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON-строка аргументов
+}
+
+// Memory — факт о людях и отношениях пользователя, который подставляется в новые чаты.
+type Memory struct {
+	ID           string `json:"id"`
+	Category     string `json:"category"` // "person", "relationship", "issue" или "other"
+	Content      string `json:"content"`
+	SourceChatID string `json:"source_chat_id,omitempty"` // чат, из которого факт извлечён; пусто — добавлен вручную
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// UsageSummary — расход на OpenAI за день (Day заполнен) или за период по пользователю.
+type UsageSummary struct {
+	UserID            string   `json:"user_id"`
+	Day               string   `json:"day,omitempty"`
+	Requests          int      `json:"requests"`
+	PromptTokens      int      `json:"prompt_tokens"`
+	CachedTokens      int      `json:"cached_tokens"`
+	CompletionTokens  int      `json:"completion_tokens"`
+	ImageTokens       int      `json:"image_tokens"` // оценка, входит в prompt_tokens
+	AudioSeconds      float64  `json:"audio_seconds"`
+	CostUSD           float64  `json:"cost_usd"`
+	Purchases         []string `json:"purchases,omitempty"`          // product_id купленных пакетов, только для group=user
+	PurchasedMessages int      `json:"purchased_messages,omitempty"` // сколько сообщений дали эти пакеты
+}
+
+// CreditQuote — цена хода в кредитах с разбивкой по надбавкам (см. pricing.go).
+type CreditQuote struct {
+	Credits         int     `json:"credits"` // итог, не больше creditMaxPerRequest
+	BaseCredits     int     `json:"base_credits"`
+	ImageCredits    int     `json:"image_credits"`
+	AudioCredits    int     `json:"audio_credits"`
+	TokenCredits    int     `json:"token_credits"`
+	Images          int     `json:"images"`
+	AudioSeconds    float64 `json:"audio_seconds"`
+	UnmeasuredVoice int     `json:"unmeasured_voice,omitempty"` // голосовые без длительности: надбавка за них доплачивается после транскрипции
+	EstimatedTokens int     `json:"estimated_tokens"`
+	Balance         int     `json:"balance,omitempty"` // только в ответе /api/chat/quote
+	Sufficient      bool    `json:"sufficient"`
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const experimentReloadInterval = time.Minute
+
+// experimentRegistry — кэш экспериментов с вариантами. Остановленные эксперименты тоже хранятся:
+// чаты, уже попавшие в вариант, продолжают использовать его модель до конца.
+type experimentRegistry struct {
+	mu   sync.RWMutex
+	byID map[string]Experiment
+}
+
+var experiments = &experimentRegistry{byID: make(map[string]Experiment)}
+
+func (e *experimentRegistry) load() error {
+	rows, err := db.Query(`
+		SELECT e.id, e.name, e.persona_id, e.status, e.created_at,
+		       v.id, v.prompt_name, v.model, v.temperature, v.weight
+		FROM experiments e
+		JOIN experiment_variants v ON v.experiment_id = e.id
+		ORDER BY e.created_at, e.id, v.id
+	`)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки экспериментов: %v", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[string]Experiment)
+	for rows.Next() {
+		var exp Experiment
+		var v ExperimentVariant
+		var personaID, promptName, model sql.NullString
+		var temperature sql.NullFloat64
+		var createdAt time.Time
+		if err := rows.Scan(&exp.ID, &exp.Name, &personaID, &exp.Status, &createdAt,
+			&v.ID, &promptName, &model, &temperature, &v.Weight); err != nil {
+			return fmt.Errorf("ошибка сканирования эксперимента: %v", err)
+		}
+		if existing, ok := byID[exp.ID]; ok {
+			exp = existing
+		} else {
+			exp.PersonaID = personaID.String
+			exp.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+			exp.created = createdAt
+		}
+		v.PromptName = promptName.String
+		v.Model = model.String
+		if temperature.Valid {
+			t := temperature.Float64
+			v.Temperature = &t
+		}
+		exp.Variants = append(exp.Variants, v)
+		byID[exp.ID] = exp
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+
+	e.mu.Lock()
+	e.byID = byID
+	e.mu.Unlock()
+	return nil
+}
+
+// assign выбирает вариант запущенного эксперимента для нового чата с данной персоной.
+// Вариант зависит только от хэша experiment_id и user_id, поэтому пользователь
+// всегда попадает в одну и ту же группу. Если экспериментов несколько, берётся самый старый.
+func (e *experimentRegistry) assign(personaID, userID string) (Experiment, ExperimentVariant, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var chosen *Experiment
+	for id := range e.byID {
+		exp := e.byID[id]
+		if exp.Status != "running" || (exp.PersonaID != "" && exp.PersonaID != personaID) {
+			continue
+		}
+		if chosen == nil || exp.created.Before(chosen.created) || (exp.created.Equal(chosen.created) && exp.ID < chosen.ID) {
+			chosen = &exp
+		}
+	}
+	if chosen == nil {
+		return Experiment{}, ExperimentVariant{}, false
+	}
+
+	total := 0
+	for _, v := range chosen.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return Experiment{}, ExperimentVariant{}, false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(chosen.ID + ":" + userID))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, v := range chosen.Variants {
+		if bucket < v.Weight {
+			return *chosen, v, true
+		}
+		bucket -= v.Weight
+	}
+	return Experiment{}, ExperimentVariant{}, false
+}
+
+func (e *experimentRegistry) variant(experimentID, variantID string) (ExperimentVariant, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, v := range e.byID[experimentID].Variants {
+		if v.ID == variantID {
+			return v, true
+		}
+	}
+	return ExperimentVariant{}, false
+}
+
+// apply подменяет в персоне промпт, модель и температуру, заданные вариантом.
+func (v ExperimentVariant) apply(p Persona) Persona {
+	if v.PromptName != "" {
+		p.PromptName = v.PromptName
+	}
+	if v.Model != "" {
+		p.Model = v.Model
+	}
+	if v.Temperature != nil {
+		p.Temperature = v.Temperature
+	}
+	return p
+}
+
+// startExperiments загружает эксперименты и периодически перечитывает их.
+func startExperiments() {
+	if err := experiments.load(); err != nil {
+		log.Printf("Ошибка загрузки экспериментов: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(experimentReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := experiments.load(); err != nil {
+				log.Printf("Ошибка перезагрузки экспериментов: %v", err)
+			}
+		}
+	}()
+}
+
+// adminExperimentsHandler (GET /api/admin/experiments) возвращает эксперименты
+// с показателями каждого варианта.
+func adminExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	stats, err := experimentVariantStats()
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения результатов экспериментов", nil, err)
+		return
+	}
+
+	experiments.mu.RLock()
+	reports := make([]ExperimentReport, 0, len(experiments.byID))
+	for _, exp := range experiments.byID {
+		report := ExperimentReport{Experiment: exp, Results: []ExperimentVariantStats{}}
+		for _, v := range exp.Variants {
+			s, ok := stats[exp.ID+"/"+v.ID]
+			if !ok {
+				s = ExperimentVariantStats{VariantID: v.ID}
+			}
+			report.Results = append(report.Results, s)
+		}
+		reports = append(reports, report)
+	}
+	experiments.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// experimentVariantStats считает показатели по вариантам:
+//   - оценки ответов (👍/👎) в чатах варианта;
+//   - follow-up rate — доля чатов, где в активной ветке больше одного сообщения пользователя
+//     (регенерации и правки создают соседние ветки и не считаются продолжением разговора);
+//   - конверсию — долю пользователей варианта, купивших пакет после попадания в эксперимент.
+func experimentVariantStats() (map[string]ExperimentVariantStats, error) {
+	rows, err := db.Query(`
+		WITH assigned AS (
+			SELECT c.experiment_id, c.variant_id, c.user_id, c.id AS chat_id, c.created_at
+			FROM chats c
+			WHERE c.experiment_id IS NOT NULL
+		),
+		chat_stats AS (
+			SELECT a.experiment_id, a.variant_id,
+			       count(*) AS chats,
+			       count(*) FILTER (WHERE (
+			           SELECT count(*) FROM messages m
+			           WHERE m.chat_id = a.chat_id AND m.role = 'user' AND m.superseded_at IS NULL
+			       ) > 1) AS follow_up_chats
+			FROM assigned a
+			GROUP BY a.experiment_id, a.variant_id
+		),
+		feedback_stats AS (
+			SELECT a.experiment_id, a.variant_id,
+			       count(*) FILTER (WHERE f.rating > 0) AS thumbs_up,
+			       count(*) FILTER (WHERE f.rating < 0) AS thumbs_down
+			FROM assigned a
+			JOIN messages m ON m.chat_id = a.chat_id
+			JOIN message_feedback f ON f.message_id = m.id
+			GROUP BY a.experiment_id, a.variant_id
+		),
+		user_stats AS (
+			SELECT u.experiment_id, u.variant_id,
+			       count(*) AS users,
+			       count(*) FILTER (WHERE EXISTS (
+			           SELECT 1 FROM processed_transactions t
+			           WHERE t.user_id = u.user_id AND t.created_at >= u.first_assigned_at
+			       )) AS converted_users
+			FROM (
+				SELECT experiment_id, variant_id, user_id, min(created_at) AS first_assigned_at
+				FROM assigned
+				GROUP BY experiment_id, variant_id, user_id
+			) u
+			GROUP BY u.experiment_id, u.variant_id
+		)
+		SELECT cs.experiment_id, cs.variant_id, cs.chats, cs.follow_up_chats,
+		       COALESCE(fs.thumbs_up, 0), COALESCE(fs.thumbs_down, 0),
+		       us.users, us.converted_users
+		FROM chat_stats cs
+		JOIN user_stats us USING (experiment_id, variant_id)
+		LEFT JOIN feedback_stats fs USING (experiment_id, variant_id)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подсчёта результатов экспериментов: %v", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[string]ExperimentVariantStats)
+	for rows.Next() {
+		var experimentID string
+		var s ExperimentVariantStats
+		if err := rows.Scan(&experimentID, &s.VariantID, &s.Chats, &s.FollowUpChats,
+			&s.ThumbsUp, &s.ThumbsDown, &s.Users, &s.ConvertedUsers); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования результатов эксперимента: %v", err)
+		}
+		if s.Chats > 0 {
+			s.FollowUpRate = float64(s.FollowUpChats) / float64(s.Chats)
+		}
+		if s.ThumbsUp+s.ThumbsDown > 0 {
+			s.ThumbsUpRate = float64(s.ThumbsUp) / float64(s.ThumbsUp+s.ThumbsDown)
+		}
+		if s.Users > 0 {
+			s.ConversionRate = float64(s.ConvertedUsers) / float64(s.Users)
+		}
+		stats[experimentID+"/"+s.VariantID] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExperimentVariantApply(t *testing.T) {
+	base, override := 0.7, 0.2
+	persona := Persona{ID: "coach", PromptName: "coach", Model: "gpt-4o-mini", Temperature: &base, MaxTokens: 800, CreditCost: 2}
+	tests := []struct {
+		name            string
+		variant         ExperimentVariant
+		wantPrompt      string
+		wantModel       string
+		wantTemperature float64
+	}{
+		{"empty variant keeps persona", ExperimentVariant{ID: "control"}, "coach", "gpt-4o-mini", 0.7},
+		{"prompt only", ExperimentVariant{ID: "b", PromptName: "coach-v2"}, "coach-v2", "gpt-4o-mini", 0.7},
+		{"model only", ExperimentVariant{ID: "b", Model: "gpt-4.1-mini"}, "coach", "gpt-4.1-mini", 0.7},
+		{"temperature only", ExperimentVariant{ID: "b", Temperature: &override}, "coach", "gpt-4o-mini", 0.2},
+		{"everything", ExperimentVariant{ID: "b", PromptName: "coach-v2", Model: "gpt-4.1", Temperature: &override}, "coach-v2", "gpt-4.1", 0.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.variant.apply(persona)
+			if got.PromptName != tt.wantPrompt || got.Model != tt.wantModel || *got.Temperature != tt.wantTemperature {
+				t.Errorf("apply = %q, %q, %v; want %q, %q, %v",
+					got.PromptName, got.Model, *got.Temperature, tt.wantPrompt, tt.wantModel, tt.wantTemperature)
+			}
+			if got.ID != persona.ID || got.MaxTokens != persona.MaxTokens || got.CreditCost != persona.CreditCost {
+				t.Errorf("apply changed fields outside the variant: %+v", got)
+			}
+		})
+	}
+	if *persona.Temperature != 0.7 {
+		t.Errorf("apply changed the original persona temperature to %v", *persona.Temperature)
+	}
+}
+
+func TestExperimentAssign(t *testing.T) {
+	older := time.Date(2024, 5, 1, 12, 0, 0, 100, time.UTC)
+	newer := time.Date(2024, 5, 1, 12, 0, 0, 900, time.UTC) // та же секунда, что и older
+	oneVariant := []ExperimentVariant{{ID: "only", Weight: 1}}
+	tests := []struct {
+		name        string
+		experiments []Experiment
+		persona     string
+		wantID      string
+		wantOK      bool
+	}{
+		{"no experiments", nil, "coach", "", false},
+		{"stopped experiment", []Experiment{{ID: "a", Status: "stopped", Variants: oneVariant, created: older}}, "coach", "", false},
+		{"other persona", []Experiment{{ID: "a", Status: "running", PersonaID: "lawyer", Variants: oneVariant, created: older}}, "coach", "", false},
+		{"all personas", []Experiment{{ID: "a", Status: "running", Variants: oneVariant, created: older}}, "coach", "a", true},
+		{"zero weights", []Experiment{{ID: "a", Status: "running", Variants: []ExperimentVariant{{ID: "x"}}, created: older}}, "coach", "", false},
+		{"oldest within the same second", []Experiment{
+			{ID: "a", Status: "running", Variants: oneVariant, created: newer},
+			{ID: "b", Status: "running", Variants: oneVariant, created: older},
+		}, "coach", "b", true},
+		{"same time, smaller id", []Experiment{
+			{ID: "b", Status: "running", Variants: oneVariant, created: older},
+			{ID: "a", Status: "running", Variants: oneVariant, created: older},
+		}, "coach", "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &experimentRegistry{byID: make(map[string]Experiment)}
+			for _, exp := range tt.experiments {
+				reg.byID[exp.ID] = exp
+			}
+			exp, v, ok := reg.assign(tt.persona, "user-1")
+			if ok != tt.wantOK || exp.ID != tt.wantID {
+				t.Fatalf("assign = %q, %v; want %q, %v", exp.ID, ok, tt.wantID, tt.wantOK)
+			}
+			if ok && v.ID != "only" {
+				t.Errorf("variant = %q, want only", v.ID)
+			}
+		})
+	}
+}
+
+func TestExperimentAssignStable(t *testing.T) {
+	reg := &experimentRegistry{byID: map[string]Experiment{
+		"a": {ID: "a", Status: "running", Variants: []ExperimentVariant{{ID: "control", Weight: 1}, {ID: "test", Weight: 1}}},
+	}}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		userID := "user-" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		_, first, _ := reg.assign("coach", userID)
+		for j := 0; j < 3; j++ {
+			if _, v, _ := reg.assign("coach", userID); v.ID != first.ID {
+				t.Fatalf("user %s moved from %s to %s", userID, first.ID, v.ID)
+			}
+		}
+		seen[first.ID] = true
+	}
+	if !seen["control"] || !seen["test"] {
+		t.Errorf("200 users fell into only %v", seen)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const (
+	defaultPDFFontPath = "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+	exportImageWidthMM = 80
+	exportImageMaxSize = 10 << 20
+)
+
+// exportHandler (GET /api/chats/{id}/export?format=md|pdf|json) отдаёт активную ветку чата файлом.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "md"
+	}
+	if format != "md" && format != "pdf" && format != "json" {
+		writeError(w, "invalid_format", "Параметр format должен быть md, pdf или json", nil, nil)
+		return
+	}
+
+	export, err := loadChatExport(chatID, true)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения чата", nil, err)
+		return
+	}
+
+	filename := fmt.Sprintf("chat-%s.%s", chatID, format)
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		json.NewEncoder(w).Encode(export)
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		io.WriteString(w, renderChatMarkdown(export))
+	case "pdf":
+		pdf, err := renderChatPDF(export)
+		if err != nil {
+			writeError(w, "pdf_error", "Ошибка формирования PDF", nil, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		if err := pdf.Output(w); err != nil {
+			log.Printf("Ошибка записи PDF для чата %s: %v", chatID, err)
+		}
+	}
+}
+
+// loadChatExport собирает активную ветку чата с транскрипциями голоса и, если includeImages,
+// подписанными ссылками на картинки.
+func loadChatExport(chatID string, includeImages bool) (ChatExport, error) {
+	export := ChatExport{
+		ChatID:     chatID,
+		ExportedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Messages:   []ExportedMessage{},
+	}
+
+	var title sql.NullString
+	var createdAt time.Time
+	err := db.QueryRow(`SELECT title, created_at FROM chats WHERE id = $1`, chatID).Scan(&title, &createdAt)
+	if err != nil {
+		return export, fmt.Errorf("ошибка получения чата: %v", err)
+	}
+	export.Title = title.String
+	export.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+
+	// includeSystem нужен, чтобы получить старые склеенные транскрипции; system-промпт и вызовы инструментов пропускаем
+	msgs, err := getChatMessages(chatID, true)
+	if err != nil {
+		return export, err
+	}
+	for _, msg := range msgs {
+		if msg.Role == "system" || msg.Role == "tool" {
+			continue
+		}
+		exported := ExportedMessage{
+			ID:                 msg.ID,
+			Role:               msg.Role,
+			Content:            msg.Content,
+			Timestamp:          msg.Timestamp,
+			VoiceTranscription: messageVoiceText(msg),
+		}
+		if includeImages {
+			for _, path := range msg.ImagePaths {
+				signedURL, err := getSignedURL(path)
+				if err != nil {
+					log.Printf("Ошибка получения signed URL для экспорта %s: %v", path, err)
+					continue
+				}
+				exported.ImageURLs = append(exported.ImageURLs, signedURL)
+			}
+		}
+		export.Messages = append(export.Messages, exported)
+	}
+	return export, nil
+}
+
+func exportRoleLabel(role string) string {
+	if role == "user" {
+		return "You"
+	}
+	return "Assistant"
+}
+
+func renderChatMarkdown(export ChatExport) string {
+	var sb strings.Builder
+	title := export.Title
+	if title == "" {
+		title = "Chat"
+	}
+	fmt.Fprintf(&sb, "# %s\n\n", title)
+	fmt.Fprintf(&sb, "_Created %s · exported %s_\n", export.CreatedAt, export.ExportedAt)
+
+	for _, msg := range export.Messages {
+		fmt.Fprintf(&sb, "\n---\n\n**%s** · %s\n\n", exportRoleLabel(msg.Role), msg.Timestamp)
+		if msg.Content != "" {
+			sb.WriteString(msg.Content)
+			sb.WriteString("\n")
+		}
+		if msg.VoiceTranscription != "" {
+			fmt.Fprintf(&sb, "\n> 🎙 %s\n", strings.ReplaceAll(msg.VoiceTranscription, "\n", "\n> "))
+		}
+		for i, url := range msg.ImageURLs {
+			fmt.Fprintf(&sb, "\n![Image %d](%s)\n", i+1, url)
+		}
+	}
+	return sb.String()
+}
+
+// renderChatPDF строит PDF локально через fpdf. Шрифт с кириллицей берётся из PDF_FONT_PATH.
+func renderChatPDF(export ChatExport) (*fpdf.Fpdf, error) {
+	fontPath := os.Getenv("PDF_FONT_PATH")
+	if fontPath == "" {
+		fontPath = defaultPDFFontPath
+	}
+	fontBytes, err := os.ReadFile(fontPath)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать шрифт для PDF: %v", err)
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("Main", "", fontBytes)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AddPage()
+
+	title := export.Title
+	if title == "" {
+		title = "Chat"
+	}
+	pdf.SetFont("Main", "", 16)
+	pdf.MultiCell(0, 8, pdfText(title), "", "L", false)
+	pdf.SetFont("Main", "", 9)
+	pdf.SetTextColor(120, 120, 120)
+	pdf.MultiCell(0, 5, fmt.Sprintf("Created %s · exported %s", export.CreatedAt, export.ExportedAt), "", "L", false)
+
+	for i, msg := range export.Messages {
+		pdf.Ln(4)
+		pdf.SetFont("Main", "", 10)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.MultiCell(0, 5, fmt.Sprintf("%s · %s", exportRoleLabel(msg.Role), msg.Timestamp), "", "L", false)
+
+		pdf.SetFont("Main", "", 11)
+		pdf.SetTextColor(0, 0, 0)
+		if msg.Content != "" {
+			pdf.MultiCell(0, 6, pdfText(msg.Content), "", "L", false)
+		}
+		if msg.VoiceTranscription != "" {
+			pdf.SetTextColor(60, 60, 60)
+			pdf.MultiCell(0, 6, pdfText("Voice: "+msg.VoiceTranscription), "", "L", false)
+			pdf.SetTextColor(0, 0, 0)
+		}
+		for j, url := range msg.ImageURLs {
+			if !embedPDFImage(pdf, fmt.Sprintf("img-%d-%d", i, j), url) {
+				pdf.SetTextColor(40, 80, 200)
+				pdf.WriteLinkString(6, fmt.Sprintf("Image %d", j+1), url)
+				pdf.Ln(6)
+				pdf.SetTextColor(0, 0, 0)
+			}
+		}
+	}
+
+	if err := pdf.Error(); err != nil {
+		return nil, err
+	}
+	return pdf, nil
+}
+
+// embedPDFImage скачивает картинку и вставляет её в PDF. fpdf понимает только JPEG, PNG и GIF;
+// для остальных форматов и для картинок больше exportImageMaxSize возвращает false, и вместо картинки ставится ссылка.
+func embedPDFImage(pdf *fpdf.Fpdf, name, url string) bool {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Printf("Ошибка скачивания картинки для PDF: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if resp.ContentLength > exportImageMaxSize {
+		log.Printf("Картинка для PDF больше %d байт, вместо неё ставится ссылка", exportImageMaxSize)
+		return false
+	}
+
+	// Читаем на байт больше лимита: обрезанная картинка не должна попасть в PDF
+	data, err := io.ReadAll(io.LimitReader(resp.Body, exportImageMaxSize+1))
+	if err != nil {
+		return false
+	}
+	if len(data) > exportImageMaxSize {
+		log.Printf("Картинка для PDF больше %d байт, вместо неё ставится ссылка", exportImageMaxSize)
+		return false
+	}
+
+	var imageType string
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		imageType = "JPG"
+	case "image/png":
+		imageType = "PNG"
+	case "image/gif":
+		imageType = "GIF"
+	default:
+		return false
+	}
+
+	opts := fpdf.ImageOptions{ImageType: imageType, ReadDpi: true}
+	pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(data))
+	if pdf.Err() {
+		log.Printf("Ошибка чтения картинки для PDF: %v", pdf.Error())
+		pdf.ClearError()
+		return false
+	}
+	pdf.ImageOptions(name, pdf.GetX(), pdf.GetY(), exportImageWidthMM, 0, true, opts, 0, "")
+	return true
+}
+
+// pdfText убирает символы вне BMP (в основном эмодзи) — их нет в шрифте и fpdf их не отрисует.
+func pdfText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0xFFFF || r == 0xFE0F {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	feedbackCommentMaxRunes = 2000
+	feedbackDefaultLimit    = 100
+	feedbackMaxLimit        = 1000
+	feedbackExportPageSize  = 1000
+)
+
+// feedbackReasons — допустимые категории причины оценки.
+var feedbackReasons = map[string]bool{
+	"inaccurate":      true,
+	"unhelpful":       true,
+	"too_harsh":       true,
+	"too_soft":        true,
+	"missed_red_flag": true,
+	"false_red_flag":  true,
+	"misread_image":   true,
+	"other":           true,
+}
+
+// feedbackHandler (POST /api/messages/{id}/feedback) сохраняет оценку ответа ассистента:
+// {"rating": "up"|"down", "reason": "...", "comment": "..."}. Повторная оценка того же сообщения заменяет предыдущую.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	var req struct {
+		Rating  string `json:"rating"`
+		Reason  string `json:"reason"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+	var rating int
+	switch req.Rating {
+	case "up":
+		rating = 1
+	case "down":
+		rating = -1
+	default:
+		writeError(w, "invalid_rating", "Параметр rating должен быть up или down", nil, nil)
+		return
+	}
+	if req.Reason != "" && !feedbackReasons[req.Reason] {
+		writeError(w, "invalid_reason", "Неизвестная причина оценки", nil, nil)
+		return
+	}
+	if !utf8.ValidString(req.Comment) {
+		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+		return
+	}
+	req.Comment = truncateUTF8(req.Comment, feedbackCommentMaxRunes)
+
+	messageID := r.PathValue("id")
+	var role string
+	err = db.QueryRow(`
+		SELECT m.role
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		WHERE m.id = $1 AND c.user_id = $2 AND c.deleted_at IS NULL
+	`, messageID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		writeError(w, "not_found", "Сообщение не найдено", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщения", nil, err)
+		return
+	}
+	if role != "assistant" {
+		writeError(w, "not_rateable", "Оценить можно только ответ ассистента", nil, nil)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO message_feedback (message_id, user_id, rating, reason, comment)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (message_id) DO UPDATE
+		SET rating = EXCLUDED.rating, reason = EXCLUDED.reason, comment = EXCLUDED.comment, updated_at = now()
+	`, messageID, userID, rating, req.Reason, req.Comment)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка сохранения оценки", nil, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminFeedbackHandler (GET /api/admin/feedback) возвращает оценки ответов вместе с версией промпта,
+// моделью, текстом ответа и вопросом пользователя. Фильтры: rating=up|down, reason, model,
+// prompt_version_id, since (RFC 3339), limit. С format=jsonl отдаёт все подходящие оценки построчно.
+func adminFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	query := r.URL.Query()
+	var rating interface{}
+	switch query.Get("rating") {
+	case "":
+	case "up":
+		rating = 1
+	case "down":
+		rating = -1
+	default:
+		writeError(w, "invalid_rating", "Параметр rating должен быть up или down", nil, nil)
+		return
+	}
+	var since interface{}
+	if s := query.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, "invalid_since", "Параметр since должен быть в формате RFC 3339", nil, err)
+			return
+		}
+		since = t
+	}
+
+	filter := feedbackFilter{
+		rating:          rating,
+		reason:          query.Get("reason"),
+		model:           query.Get("model"),
+		promptVersionID: query.Get("prompt_version_id"),
+		since:           since,
+	}
+
+	if query.Get("format") == "jsonl" {
+		exportFeedback(w, filter)
+		return
+	}
+
+	limit := feedbackDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, "invalid_limit", "Параметр limit должен быть положительным числом", nil, err)
+			return
+		}
+		limit = min(n, feedbackMaxLimit)
+	}
+
+	items, _, err := queryFeedback(filter, nil, limit)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения оценок", nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// exportFeedback построчно выгружает все подходящие оценки, читая их страницами по ключу
+// (updated_at, message_id), чтобы не держать всю выгрузку в одном запросе.
+func exportFeedback(w http.ResponseWriter, filter feedbackFilter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="feedback.jsonl"`)
+	enc := json.NewEncoder(w)
+
+	var after *feedbackCursor
+	for {
+		items, last, err := queryFeedback(filter, after, feedbackExportPageSize)
+		if err != nil {
+			// Заголовки уже могли уйти клиенту: обрыв выгрузки виден только в логах
+			log.Printf("Ошибка выгрузки оценок: %v", err)
+			return
+		}
+		for _, rec := range items {
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("Ошибка записи выгрузки оценок: %v", err)
+				return
+			}
+		}
+		if len(items) < feedbackExportPageSize {
+			return
+		}
+		after = &last
+	}
+}
+
+// feedbackFilter — фильтры adminFeedbackHandler; nil и пустые строки означают «без фильтра».
+type feedbackFilter struct {
+	rating          interface{}
+	reason          string
+	model           string
+	promptVersionID string
+	since           interface{}
+}
+
+// feedbackCursor — позиция последней выданной оценки в порядке updated_at DESC, message_id DESC.
+type feedbackCursor struct {
+	updatedAt time.Time
+	messageID string
+}
+
+// queryFeedback возвращает до limit оценок, новые первыми, начиная после after (nil — с начала),
+// и позицию последней из них.
+func queryFeedback(filter feedbackFilter, after *feedbackCursor, limit int) ([]FeedbackRecord, feedbackCursor, error) {
+	var afterTime, afterID interface{}
+	if after != nil {
+		afterTime, afterID = after.updatedAt, after.messageID
+	}
+	rows, err := db.Query(`
+		SELECT f.message_id, m.chat_id, f.rating, COALESCE(f.reason, ''), COALESCE(f.comment, ''),
+		       COALESCE(m.model, ''), COALESCE(m.prompt_version_id, c.prompt_version_id)::text,
+		       COALESCE(p.name, ''), COALESCE(p.version, 0),
+		       COALESCE(c.persona_id, ''), COALESCE(c.experiment_id, ''), COALESCE(c.variant_id, ''),
+		       COALESCE(u.content, ''), m.content, f.updated_at
+		FROM message_feedback f
+		JOIN messages m ON m.id = f.message_id
+		JOIN chats c ON c.id = m.chat_id
+		LEFT JOIN LATERAL (
+			-- Между вопросом и ответом могут стоять вызовы инструментов
+			WITH RECURSIVE up AS (
+				SELECT id, parent_id, role, content FROM messages WHERE id = m.parent_id
+				UNION ALL
+				SELECT pm.id, pm.parent_id, pm.role, pm.content FROM messages pm JOIN up ON pm.id = up.parent_id WHERE up.role = 'tool'
+			)
+			SELECT content FROM up WHERE role = 'user' LIMIT 1
+		) u ON true
+		LEFT JOIN prompts p ON p.id = COALESCE(m.prompt_version_id, c.prompt_version_id)
+		WHERE ($1::smallint IS NULL OR f.rating = $1)
+		  AND ($2 = '' OR f.reason = $2)
+		  AND ($3 = '' OR m.model = $3)
+		  AND ($4 = '' OR COALESCE(m.prompt_version_id, c.prompt_version_id)::text = $4)
+		  AND ($5::timestamptz IS NULL OR f.updated_at >= $5)
+		  AND ($6::timestamptz IS NULL OR (f.updated_at, f.message_id) < ($6::timestamptz, $7::uuid))
+		ORDER BY f.updated_at DESC, f.message_id DESC
+		LIMIT $8
+	`, filter.rating, filter.reason, filter.model, filter.promptVersionID, filter.since, afterTime, afterID, limit)
+	if err != nil {
+		return nil, feedbackCursor{}, fmt.Errorf("ошибка получения оценок: %v", err)
+	}
+	defer rows.Close()
+
+	items := []FeedbackRecord{}
+	var last feedbackCursor
+	for rows.Next() {
+		rec, updatedAt, err := scanFeedbackRecord(rows)
+		if err != nil {
+			return nil, feedbackCursor{}, err
+		}
+		items = append(items, rec)
+		last = feedbackCursor{updatedAt: updatedAt, messageID: rec.MessageID}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, feedbackCursor{}, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return items, last, nil
+}
+
+func scanFeedbackRecord(rows *sql.Rows) (FeedbackRecord, time.Time, error) {
+	var rec FeedbackRecord
+	var rating int
+	var promptVersionID sql.NullString
+	var updatedAt time.Time
+	err := rows.Scan(&rec.MessageID, &rec.ChatID, &rating, &rec.Reason, &rec.Comment,
+		&rec.Model, &promptVersionID, &rec.PromptName, &rec.PromptVersion,
+		&rec.PersonaID, &rec.ExperimentID, &rec.VariantID,
+		&rec.UserMessage, &rec.AssistantMessage, &updatedAt)
+	if err != nil {
+		return rec, updatedAt, fmt.Errorf("ошибка сканирования оценки: %v", err)
+	}
+	rec.Rating = "up"
+	if rating < 0 {
+		rec.Rating = "down"
+	}
+	rec.PromptVersionID = promptVersionID.String
+	rec.RatedAt = updatedAt.Format("2006-01-02T15:04:05Z")
+	return rec, updatedAt, nil
+}
@@ -35,12 +35,42 @@ func main() {
 	}
 	log.Println("Подключение к Supabase установлено!")
 
+	startPromptRegistry()
+	startPersonaCatalog()
+	startExperiments()
+	startTranscriptionWorkers()
+	schedulePendingChatPurges()
+	schedulePendingAccountDeletions()
+
 	http.HandleFunc("/api/launch", launchHandler)
 	http.HandleFunc("/api/sign_up", signUpHandler)
 	http.HandleFunc("/api/chat", chatHandler)
+	http.HandleFunc("/api/chat/quote", chatQuoteHandler)
+	http.HandleFunc("/api/chat/{id}/regenerate", regenerateHandler)
+	http.HandleFunc("/api/chat/{id}/messages/{message_id}", editMessageHandler)
+	http.HandleFunc("/api/chat/{id}/branches", branchesHandler)
 	http.HandleFunc("/api/chats", chatsHandler)
+	http.HandleFunc("/api/chats/{id}", chatItemHandler)
+	http.HandleFunc("/api/chats/{id}/export", exportHandler)
+	http.HandleFunc("/api/chats/{id}/share", shareHandler)
+	http.HandleFunc("/api/chats/{id}/share/{share_id}", shareRevokeHandler)
+	http.HandleFunc("/s/{token}", publicShareHandler)
 	http.HandleFunc("/api/webhook/revenuecat", revenueCatWebhookHandler)
 	http.HandleFunc("/api/confirmation", confirmationHandler)
+	http.HandleFunc("/api/transcriptions", transcriptionsHandler)
+	http.HandleFunc("/api/search", searchHandler)
+	http.HandleFunc("/api/account", accountHandler)
+	http.HandleFunc("/api/account/export", accountExportHandler)
+	http.HandleFunc("/api/account/deletions/{id}", accountDeletionHandler)
+	http.HandleFunc("/api/admin/prompts", adminPromptsHandler)
+	http.HandleFunc("/api/personas", personasHandler)
+	http.HandleFunc("/api/messages/{id}/feedback", feedbackHandler)
+	http.HandleFunc("/api/admin/experiments", adminExperimentsHandler)
+	http.HandleFunc("/api/admin/feedback", adminFeedbackHandler)
+	http.HandleFunc("/api/admin/usage", adminUsageHandler)
+	http.HandleFunc("/api/memories", memoriesHandler)
+	http.HandleFunc("/api/memories/settings", memorySettingsHandler)
+	http.HandleFunc("/api/memories/{id}", memoryItemHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	memoryModel           = "gpt-4o-mini"
+	memoryMaxPerUser      = 200
+	memoryMaxRunes        = 500
+	memoryContextMax      = 50 // сколько последних фактов подставляется в новый чат
+	memorySourceRunes     = 4000
+	memoryReplyRunes      = 1500
+	memoryExtractMaxNew   = 5
+	memoryDefaultCategory = "other"
+)
+
+// memoryCategories — допустимые категории фактов.
+var memoryCategories = map[string]bool{
+	"person":       true,
+	"relationship": true,
+	"issue":        true,
+	"other":        true,
+}
+
+const memoryExtractPrompt = `You maintain a short memory about the user's relationships so that future conversations do not start from scratch.
+From the conversation below, extract NEW long-lived facts worth remembering: who the people are (names and who they are to the user),
+the status of relationships, and recurring issues. Ignore one-off details, the assistant's opinions and anything already in the known facts.
+Write each fact as one short sentence in the user's language.
+Return ONLY a JSON object: {"facts": [{"category": "person|relationship|issue|other", "content": "..."}]}.
+Return an empty "facts" array if there is nothing new.`
+
+// memoryEnabled сообщает, включена ли память у пользователя.
+func memoryEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT memory_enabled FROM users WHERE id = $1`, userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("ошибка получения настройки памяти: %v", err)
+	}
+	return enabled, nil
+}
+
+// listMemories возвращает факты пользователя, новые первыми.
+func listMemories(userID string, limit int) ([]Memory, error) {
+	rows, err := db.Query(`
+		SELECT id, category, content, source_chat_id, created_at, updated_at
+		FROM user_memories
+		WHERE user_id = $1
+		ORDER BY updated_at DESC, id
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения памяти: %v", err)
+	}
+	defer rows.Close()
+
+	memories := []Memory{}
+	for rows.Next() {
+		m, err := scanMemory(rows)
+		if err != nil {
+			return nil, err
+		}
+		memories = append(memories, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return memories, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMemory(row rowScanner) (Memory, error) {
+	var m Memory
+	var sourceChatID sql.NullString
+	var createdAt, updatedAt time.Time
+	if err := row.Scan(&m.ID, &m.Category, &m.Content, &sourceChatID, &createdAt, &updatedAt); err != nil {
+		return m, err
+	}
+	m.SourceChatID = sourceChatID.String
+	m.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	m.UpdatedAt = updatedAt.Format("2006-01-02T15:04:05Z")
+	return m, nil
+}
+
+// insertMemory добавляет факт, если у пользователя ещё нет такого же и не превышен лимит.
+// Возвращает false, если факт не добавлен. Вставки одного пользователя (фоновое извлечение
+// и POST /api/memories) выполняются по очереди под блокировкой строки users, иначе обе
+// могли бы пройти проверку лимита и дубликата одновременно.
+func insertMemory(userID, category, content, sourceChatID string) (Memory, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Memory{}, false, fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return Memory{}, false, fmt.Errorf("ошибка блокировки памяти пользователя: %v", err)
+	}
+	m, err := scanMemory(tx.QueryRow(`
+		INSERT INTO user_memories (user_id, category, content, source_chat_id)
+		SELECT $1, $2, $3, NULLIF($4, '')::uuid
+		WHERE NOT EXISTS (SELECT 1 FROM user_memories WHERE user_id = $1 AND lower(content) = lower($3))
+		  AND (SELECT count(*) FROM user_memories WHERE user_id = $1) < $5
+		RETURNING id, category, content, source_chat_id, created_at, updated_at
+	`, userID, category, content, sourceChatID, memoryMaxPerUser))
+	if err == sql.ErrNoRows {
+		return m, false, nil
+	} else if err != nil {
+		return m, false, fmt.Errorf("ошибка сохранения памяти: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return m, false, fmt.Errorf("ошибка сохранения памяти: %v", err)
+	}
+	return m, true, nil
+}
+
+// clearChatMemorySnapshots убирает снимки памяти из чатов пользователя. Вызывается, когда факты
+// исправлены или удалены либо память выключена: модель не должна видеть их в уже начатых чатах.
+func clearChatMemorySnapshots(userID string) error {
+	_, err := db.Exec(`UPDATE chats SET memory_context = NULL WHERE user_id = $1 AND memory_context IS NOT NULL`, userID)
+	if err != nil {
+		return fmt.Errorf("ошибка очистки памяти чатов: %v", err)
+	}
+	return nil
+}
+
+// memoryContext собирает блок с фактами о пользователе для system-промпта нового чата.
+// Пустая строка — память выключена или пуста.
+func memoryContext(userID string) (string, error) {
+	enabled, err := memoryEnabled(userID)
+	if err != nil || !enabled {
+		return "", err
+	}
+	memories, err := listMemories(userID, memoryContextMax)
+	if err != nil || len(memories) == 0 {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("What you already know about the user from previous conversations (the user may correct it):")
+	for _, m := range memories {
+		b.WriteString("\n- ")
+		b.WriteString(m.Content)
+	}
+	return b.String(), nil
+}
+
+// snapshotChatMemory сохраняет в новый чат текущую память пользователя. Снимок не меняется
+// до конца чата, чтобы контекст модели был одинаковым во всех ходах и при перегенерации;
+// исправление или удаление фактов и выключение памяти убирают его (clearChatMemorySnapshots).
+func snapshotChatMemory(chatID, userID string) error {
+	block, err := memoryContext(userID)
+	if err != nil || block == "" {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE chats SET memory_context = $2 WHERE id = $1`, chatID, block); err != nil {
+		return fmt.Errorf("ошибка сохранения памяти чата: %v", err)
+	}
+	return nil
+}
+
+// extractMemories после ответа ассистента просит модель выделить новые факты о людях и отношениях
+// пользователя и сохраняет их. Запускается в фоне, не списывает кредиты; ошибки только логируются.
+func extractMemories(userID, chatID, userText, assistantReply string) {
+	if strings.TrimSpace(userText) == "" {
+		return
+	}
+	enabled, err := memoryEnabled(userID)
+	if err != nil {
+		log.Printf("Ошибка извлечения памяти из чата %s: %v", chatID, err)
+		return
+	}
+	if !enabled {
+		return
+	}
+
+	known, err := listMemories(userID, memoryMaxPerUser)
+	if err != nil {
+		log.Printf("Ошибка извлечения памяти из чата %s: %v", chatID, err)
+		return
+	}
+	if len(known) >= memoryMaxPerUser {
+		return
+	}
+	var knownFacts strings.Builder
+	for _, m := range known {
+		knownFacts.WriteString("- " + m.Content + "\n")
+	}
+	if knownFacts.Len() == 0 {
+		knownFacts.WriteString("(none)\n")
+	}
+
+	conversation := "Known facts:\n" + knownFacts.String() +
+		"\nUser: " + truncateUTF8(userText, memorySourceRunes) +
+		"\n\nAssistant: " + truncateUTF8(assistantReply, memoryReplyRunes)
+
+	extractReq := VisionRequest{
+		Model: memoryModel,
+		Messages: []VisionMessage{
+			{Role: "system", Content: []VisionContentItem{{Type: "text", Text: memoryExtractPrompt}}},
+			{Role: "user", Content: []VisionContentItem{{Type: "text", Text: conversation}}},
+		},
+		ResponseFormat: &ResponseFormat{Type: "json_object"},
+	}
+	openaiResp, err := requestChatCompletion(extractReq)
+	if err != nil {
+		log.Printf("Ошибка извлечения памяти из чата %s: %v", chatID, err)
+		return
+	}
+	var usage usageStats
+	usage.addCompletion(extractReq.Model, extractReq, openaiResp)
+	recordUsage(userID, usage)
+
+	var result struct {
+		Facts []struct {
+			Category string `json:"category"`
+			Content  string `json:"content"`
+		} `json:"facts"`
+	}
+	if err := json.Unmarshal([]byte(openaiResp.Choices[0].Message.Content), &result); err != nil {
+		log.Printf("Некорректный ответ при извлечении памяти из чата %s: %v", chatID, err)
+		return
+	}
+
+	added := 0
+	for _, f := range result.Facts {
+		if added >= memoryExtractMaxNew {
+			break
+		}
+		content := truncateUTF8(strings.TrimSpace(f.Content), memoryMaxRunes)
+		if content == "" || !utf8.ValidString(content) {
+			continue
+		}
+		category := f.Category
+		if !memoryCategories[category] {
+			category = memoryDefaultCategory
+		}
+		_, ok, err := insertMemory(userID, category, content, chatID)
+		if err != nil {
+			log.Printf("Ошибка сохранения памяти из чата %s: %v", chatID, err)
+			return
+		}
+		if ok {
+			added++
+		}
+	}
+}
+
+// parseMemoryInput проверяет текст и категорию факта из запроса. Пустая категория — "other".
+func parseMemoryInput(w http.ResponseWriter, content, category string) (string, string, bool) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		writeError(w, "invalid_content", "Текст факта не может быть пустым", nil, nil)
+		return "", "", false
+	}
+	if !utf8.ValidString(content) {
+		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+		return "", "", false
+	}
+	if category == "" {
+		category = memoryDefaultCategory
+	}
+	if !memoryCategories[category] {
+		writeError(w, "invalid_category", "Неизвестная категория факта", nil, nil)
+		return "", "", false
+	}
+	return truncateUTF8(content, memoryMaxRunes), category, true
+}
+
+// memoriesHandler обслуживает /api/memories: GET возвращает факты пользователя,
+// POST добавляет факт {"content": "...", "category": "..."}, DELETE удаляет всю память.
+func memoriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		memories, err := listMemories(userID, memoryMaxPerUser)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка получения памяти", nil, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(memories)
+
+	case http.MethodPost:
+		var req struct {
+			Content  string `json:"content"`
+			Category string `json:"category"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+			return
+		}
+		content, category, ok := parseMemoryInput(w, req.Content, req.Category)
+		if !ok {
+			return
+		}
+		m, added, err := insertMemory(userID, category, content, "")
+		if err != nil {
+			writeError(w, "db_error", "Ошибка сохранения факта", nil, err)
+			return
+		}
+		if !added {
+			writeError(w, "memory_not_added", "Такой факт уже есть или достигнут лимит памяти", nil, nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m)
+
+	case http.MethodDelete:
+		if _, err := db.Exec(`DELETE FROM user_memories WHERE user_id = $1`, userID); err != nil {
+			writeError(w, "db_error", "Ошибка удаления памяти", nil, err)
+			return
+		}
+		if err := clearChatMemorySnapshots(userID); err != nil {
+			writeError(w, "db_error", "Ошибка удаления памяти", nil, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+// memoryItemHandler обслуживает /api/memories/{id}: PATCH исправляет факт, DELETE удаляет его.
+func memoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+	memoryID := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req struct {
+			Content  string `json:"content"`
+			Category string `json:"category"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+			return
+		}
+		content, category, ok := parseMemoryInput(w, req.Content, req.Category)
+		if !ok {
+			return
+		}
+		m, err := scanMemory(db.QueryRow(`
+			UPDATE user_memories
+			SET content = $3, category = $4, updated_at = now()
+			WHERE id = $1 AND user_id = $2
+			RETURNING id, category, content, source_chat_id, created_at, updated_at
+		`, memoryID, userID, content, category))
+		if err == sql.ErrNoRows {
+			writeError(w, "not_found", "Факт не найден", nil, nil)
+			return
+		} else if err != nil {
+			writeError(w, "db_error", "Ошибка обновления факта", nil, err)
+			return
+		}
+		if err := clearChatMemorySnapshots(userID); err != nil {
+			writeError(w, "db_error", "Ошибка обновления факта", nil, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+
+	case http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM user_memories WHERE id = $1 AND user_id = $2`, memoryID, userID)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка удаления факта", nil, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeError(w, "not_found", "Факт не найден", nil, nil)
+			return
+		}
+		if err := clearChatMemorySnapshots(userID); err != nil {
+			writeError(w, "db_error", "Ошибка удаления факта", nil, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+// memorySettingsHandler обслуживает /api/memories/settings: GET возвращает {"enabled": bool},
+// PUT включает или выключает память. Выключенная память не пополняется и не подставляется
+// ни в новые, ни в уже начатые чаты; сохранённые факты остаются, пока пользователь их не удалит.
+func memorySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	var settings struct {
+		Enabled *bool `json:"enabled"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		enabled, err := memoryEnabled(userID)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка получения настройки памяти", nil, err)
+			return
+		}
+		settings.Enabled = &enabled
+
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+			return
+		}
+		if settings.Enabled == nil {
+			writeError(w, "invalid_enabled", "Параметр enabled обязателен", nil, nil)
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET memory_enabled = $2 WHERE id = $1`, userID, *settings.Enabled); err != nil {
+			writeError(w, "db_error", "Ошибка сохранения настройки памяти", nil, err)
+			return
+		}
+		if !*settings.Enabled {
+			if err := clearChatMemorySnapshots(userID); err != nil {
+				writeError(w, "db_error", "Ошибка сохранения настройки памяти", nil, err)
+				return
+			}
+		}
+
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
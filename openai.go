@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+// openAIStatusError — ответ OpenAI с кодом, отличным от 200.
+type openAIStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *openAIStatusError) Error() string {
+	return fmt.Sprintf("OpenAI вернул ошибку %d: %s", e.StatusCode, e.Body)
+}
+
+// isRetryableError сообщает, имеет ли смысл повторить запрос: сетевые сбои, 429 и 5xx.
+func isRetryableError(err error) bool {
+	var statusErr *openAIStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// requestChatCompletion отправляет запрос в OpenAI Chat Completions и возвращает разобранный ответ.
+func requestChatCompletion(visionReq VisionRequest) (*OpenAIResponse, error) {
+	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
+	if openaiAPIKey == "" {
+		return nil, fmt.Errorf("сервер не настроен (отсутствует API ключ)")
+	}
+
+	jsonData, err := json.Marshal(visionReq)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка формирования JSON для OpenAI: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса к OpenAI: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка выполнения запроса к OpenAI: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа от OpenAI: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &openAIStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var openaiResp OpenAIResponse
+	if err := json.Unmarshal(body, &openaiResp); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга JSON ответа: %v", err)
+	}
+	if len(openaiResp.Choices) == 0 {
+		return nil, fmt.Errorf("OpenAI не вернул ответа")
+	}
+	return &openaiResp, nil
+}
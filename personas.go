@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPersonaID      = "red_flag_detector"
+	personaReloadInterval = time.Minute
+	attachmentImage       = "image"
+	attachmentVoice       = "voice"
+	tierFree              = "free"
+	tierPaid              = "paid"
+)
+
+// defaultPersona используется для чатов, созданных до появления персон, и если каталог в базе пуст.
+var defaultPersona = Persona{
+	ID:                 defaultPersonaID,
+	Name:               "Red-flag detector",
+	PromptName:         systemPromptName,
+	Model:              chatModel,
+	MaxTokens:          chatMaxTokens,
+	FallbackModel:      chatFallbackModel,
+	AllowedAttachments: []string{attachmentImage, attachmentVoice},
+	CreditCost:         1,
+}
+
+// personaCatalog — кэш таблицы personas. Отключённые персоны тоже хранятся:
+// чаты, созданные с ними, продолжают работать, но новые с ними не создаются.
+type personaCatalog struct {
+	mu   sync.RWMutex
+	byID map[string]Persona
+	list []Persona // включённые персоны в порядке показа
+}
+
+var personas = &personaCatalog{byID: map[string]Persona{defaultPersonaID: defaultPersona}}
+
+func (c *personaCatalog) load() error {
+	rows, err := db.Query(`
+		SELECT id, name, description, prompt_name, model, temperature, max_tokens, fallback_model,
+		       allowed_attachments, credit_cost, enabled
+		FROM personas
+		ORDER BY sort_order, id
+	`)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки персон: %v", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[string]Persona)
+	var order []string // включённые персоны в порядке показа
+	for rows.Next() {
+		var p Persona
+		var description sql.NullString
+		var temperature sql.NullFloat64
+		var maxTokens sql.NullInt64
+		var fallbackModel sql.NullString
+		var enabled bool
+		if err := rows.Scan(&p.ID, &p.Name, &description, &p.PromptName, &p.Model, &temperature, &maxTokens, &fallbackModel,
+			pq.Array(&p.AllowedAttachments), &p.CreditCost, &enabled); err != nil {
+			return fmt.Errorf("ошибка сканирования персоны: %v", err)
+		}
+		p.Description = description.String
+		if temperature.Valid {
+			t := temperature.Float64
+			p.Temperature = &t
+		}
+		p.MaxTokens = int(maxTokens.Int64)
+		p.FallbackModel = fallbackModel.String
+		byID[p.ID] = p
+		if enabled {
+			order = append(order, p.ID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+
+	tiers, err := loadPersonaModels()
+	if err != nil {
+		return err
+	}
+	for id, t := range tiers {
+		if p, ok := byID[id]; ok {
+			p.Tiers = t
+			byID[id] = p
+		}
+	}
+	var list []Persona
+	for _, id := range order {
+		list = append(list, byID[id])
+	}
+
+	if _, ok := byID[defaultPersonaID]; !ok {
+		byID[defaultPersonaID] = defaultPersona
+		list = append([]Persona{defaultPersona}, list...)
+	}
+
+	c.mu.Lock()
+	c.byID = byID
+	c.list = list
+	c.mu.Unlock()
+	return nil
+}
+
+// loadPersonaModels читает настройки моделей персон по тарифам: persona_id → тариф → настройки.
+func loadPersonaModels() (map[string]map[string]PersonaModel, error) {
+	rows, err := db.Query(`
+		SELECT persona_id, tier, model, fallback_model, max_tokens, temperature
+		FROM persona_models
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки моделей персон: %v", err)
+	}
+	defer rows.Close()
+
+	tiers := make(map[string]map[string]PersonaModel)
+	for rows.Next() {
+		var personaID, tier string
+		var model, fallbackModel sql.NullString
+		var maxTokens sql.NullInt64
+		var temperature sql.NullFloat64
+		if err := rows.Scan(&personaID, &tier, &model, &fallbackModel, &maxTokens, &temperature); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования модели персоны: %v", err)
+		}
+		m := PersonaModel{Model: model.String, FallbackModel: fallbackModel.String, MaxTokens: int(maxTokens.Int64)}
+		if temperature.Valid {
+			t := temperature.Float64
+			m.Temperature = &t
+		}
+		if tiers[personaID] == nil {
+			tiers[personaID] = make(map[string]PersonaModel)
+		}
+		tiers[personaID][tier] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return tiers, nil
+}
+
+// get возвращает персону по id; enabledOnly отсекает персоны, снятые с показа.
+func (c *personaCatalog) get(id string, enabledOnly bool) (Persona, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !enabledOnly {
+		p, ok := c.byID[id]
+		return p, ok
+	}
+	for _, p := range c.list {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Persona{}, false
+}
+
+func (c *personaCatalog) enabled() []Persona {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Persona(nil), c.list...)
+}
+
+// startPersonaCatalog загружает каталог персон и периодически перечитывает его.
+func startPersonaCatalog() {
+	if err := personas.load(); err != nil {
+		log.Printf("Ошибка загрузки персон: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(personaReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := personas.load(); err != nil {
+				log.Printf("Ошибка перезагрузки персон: %v", err)
+			}
+		}
+	}()
+}
+
+// allows проверяет, принимает ли персона вложения данного типа.
+func (p Persona) allows(attachment string) bool {
+	for _, a := range p.AllowedAttachments {
+		if a == attachment {
+			return true
+		}
+	}
+	return false
+}
+
+// forTier применяет настройки модели для тарифа пользователя ("free" или "paid"). Тариф ограничивает
+// всё остальное, поэтому применяется последним — после варианта эксперимента: иначе эксперимент
+// мог бы выдать бесплатному пользователю модель платного тарифа.
+func (p Persona) forTier(tier string) Persona {
+	m, ok := p.Tiers[tier]
+	if !ok {
+		return p
+	}
+	if m.Model != "" {
+		p.Model = m.Model
+	}
+	if m.FallbackModel != "" {
+		p.FallbackModel = m.FallbackModel
+	}
+	if m.MaxTokens > 0 {
+		p.MaxTokens = m.MaxTokens
+	}
+	if m.Temperature != nil {
+		p.Temperature = m.Temperature
+	}
+	return p
+}
+
+// userTier возвращает тариф пользователя: "paid", если он расходует купленный пакет, иначе "free".
+func userTier(isUsingPaid bool) string {
+	if isUsingPaid {
+		return tierPaid
+	}
+	return tierFree
+}
+
+// chatPersona возвращает персону, с которой был создан чат, с учётом варианта эксперимента
+// и с моделью для текущего тарифа владельца. Для старых чатов — персона по умолчанию.
+func chatPersona(chatID string) (Persona, error) {
+	var personaID, experimentID, variantID sql.NullString
+	var isUsingPaid bool
+	err := db.QueryRow(`
+		SELECT c.persona_id, c.experiment_id, c.variant_id, COALESCE(uc.is_using_paid, false)
+		FROM chats c
+		LEFT JOIN user_credits uc ON uc.user_id = c.user_id
+		WHERE c.id = $1
+	`, chatID).Scan(&personaID, &experimentID, &variantID, &isUsingPaid)
+	if err == sql.ErrNoRows {
+		return defaultPersona, nil
+	} else if err != nil {
+		return Persona{}, fmt.Errorf("ошибка получения персоны чата: %v", err)
+	}
+
+	p := defaultPersona
+	if personaID.Valid {
+		var ok bool
+		p, ok = personas.get(personaID.String, false)
+		if !ok {
+			log.Printf("Персона %s чата %s не найдена в каталоге, используется персона по умолчанию", personaID.String, chatID)
+			p = defaultPersona
+		}
+	}
+	if experimentID.Valid && variantID.Valid {
+		if v, ok := experiments.variant(experimentID.String, variantID.String); ok {
+			p = v.apply(p)
+		}
+	}
+	return p.forTier(userTier(isUsingPaid)), nil
+}
+
+// personasHandler (GET /api/personas) возвращает доступные режимы анализа с моделями для тарифа
+// вызывающего пользователя. Без заголовка Authorization показываются модели бесплатного тарифа.
+func personasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	tier := tierFree
+	if r.Header.Get("Authorization") != "" {
+		userID, err := getUserIDFromRequest(r)
+		if err != nil {
+			writeError(w, "unauthorized", err.Error(), nil, err)
+			return
+		}
+		var isUsingPaid bool
+		err = db.QueryRow(`
+			SELECT COALESCE((SELECT is_using_paid FROM user_credits WHERE user_id = $1), false)
+		`, userID).Scan(&isUsingPaid)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка получения тарифа", nil, err)
+			return
+		}
+		tier = userTier(isUsingPaid)
+	}
+
+	list := personas.enabled()
+	for i := range list {
+		list[i] = list[i].forTier(tier)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestPersonaForTier(t *testing.T) {
+	base, freeTemp := 0.7, 0.3
+	persona := Persona{
+		ID: "coach", Model: "gpt-4o", FallbackModel: "gpt-4o-mini", MaxTokens: 1500, Temperature: &base,
+		Tiers: map[string]PersonaModel{
+			tierFree: {Model: "gpt-4o-mini", FallbackModel: "gpt-4.1-nano", MaxTokens: 600, Temperature: &freeTemp},
+			tierPaid: {MaxTokens: 3000},
+		},
+	}
+	tests := []struct {
+		name          string
+		persona       Persona
+		tier          string
+		wantModel     string
+		wantFallback  string
+		wantMaxTokens int
+		wantTemp      float64
+	}{
+		{"free overrides everything", persona, tierFree, "gpt-4o-mini", "gpt-4.1-nano", 600, 0.3},
+		{"paid overrides only max tokens", persona, tierPaid, "gpt-4o", "gpt-4o-mini", 3000, 0.7},
+		{"unknown tier", persona, "enterprise", "gpt-4o", "gpt-4o-mini", 1500, 0.7},
+		{"no tiers", Persona{Model: "gpt-4o", FallbackModel: "gpt-4o-mini", MaxTokens: 1500, Temperature: &base}, tierFree, "gpt-4o", "gpt-4o-mini", 1500, 0.7},
+		{"variant model is capped by free tier", ExperimentVariant{Model: "gpt-4.1"}.apply(persona), tierFree, "gpt-4o-mini", "gpt-4.1-nano", 600, 0.3},
+		{"variant model kept for paid tier without model", ExperimentVariant{Model: "gpt-4.1"}.apply(persona), tierPaid, "gpt-4.1", "gpt-4o-mini", 3000, 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.persona.forTier(tt.tier)
+			if got.Model != tt.wantModel || got.FallbackModel != tt.wantFallback || got.MaxTokens != tt.wantMaxTokens || *got.Temperature != tt.wantTemp {
+				t.Errorf("forTier(%q) = %s/%s/%d/%v, want %s/%s/%d/%v", tt.tier,
+					got.Model, got.FallbackModel, got.MaxTokens, *got.Temperature,
+					tt.wantModel, tt.wantFallback, tt.wantMaxTokens, tt.wantTemp)
+			}
+		})
+	}
+}
+
+func TestUserTier(t *testing.T) {
+	if got := userTier(true); got != tierPaid {
+		t.Errorf("userTier(true) = %q, want %q", got, tierPaid)
+	}
+	if got := userTier(false); got != tierFree {
+		t.Errorf("userTier(false) = %q, want %q", got, tierFree)
+	}
+}
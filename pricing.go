@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Политика цены хода: базовая цена персоны плюс надбавки за скриншоты, длительность голосовых
+// и объём контекста. В базовую цену входят несколько скриншотов, минута аудио и обычный разговор.
+const (
+	creditImagesIncluded  = 2    // скриншотов без надбавки
+	creditImagesPerCredit = 3    // каждые следующие 3 скриншота — +1 кредит
+	creditAudioIncluded   = 60   // секунд аудио без надбавки
+	creditAudioPerCredit  = 120  // каждые следующие 2 минуты — +1 кредит
+	creditTokensIncluded  = 8000 // токенов контекста без надбавки
+	creditTokensPerCredit = 8000 // каждые следующие 8000 токенов — +1 кредит
+	creditMaxPerRequest   = 10
+
+	tokenRunesRatio      = 3 // примерно столько символов на токен в смеси русского и английского
+	audioTokensPerSecond = 3 // примерно столько токенов даёт секунда речи в транскрипции
+)
+
+// creditSurcharge — надбавка за объём сверх включённого: +1 кредит за каждую начатую порцию perCredit.
+func creditSurcharge(amount, included, perCredit float64) int {
+	if amount <= included {
+		return 0
+	}
+	extra := amount - included
+	n := int(extra / perCredit)
+	if float64(n)*perCredit < extra {
+		n++
+	}
+	return n
+}
+
+// estimateTokens грубо оценивает число токенов в тексте.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + tokenRunesRatio - 1) / tokenRunesRatio
+}
+
+// quoteCredits считает цену хода. history — уже сохранённая ветка чата; system-сообщения не учитываются,
+// чтобы цена не зависела от длины промпта и памяти.
+func quoteCredits(persona Persona, history []Message, prompt string, images int, audioSeconds float64) CreditQuote {
+	tokens := estimateTokens(prompt) + int(audioSeconds*audioTokensPerSecond)
+	for _, m := range history {
+		if m.Role == "system" || m.Role == "tool" {
+			continue
+		}
+		tokens += estimateTokens(m.Content) + estimateTokens(messageVoiceText(m))
+		if len(m.ImageTranscripts) > 0 {
+			tokens += estimateTokens(formatScreenshotTranscripts(m.ImageTranscripts))
+		}
+	}
+
+	q := CreditQuote{
+		BaseCredits:     max(persona.CreditCost, 1),
+		ImageCredits:    creditSurcharge(float64(images), creditImagesIncluded, creditImagesPerCredit),
+		AudioCredits:    creditSurcharge(audioSeconds, creditAudioIncluded, creditAudioPerCredit),
+		TokenCredits:    creditSurcharge(float64(tokens), creditTokensIncluded, creditTokensPerCredit),
+		Images:          images,
+		AudioSeconds:    audioSeconds,
+		EstimatedTokens: tokens,
+	}
+	q.Credits = min(q.BaseCredits+q.ImageCredits+q.AudioCredits+q.TokenCredits, creditMaxPerRequest)
+	return q
+}
+
+// withAudio пересчитывает цену для фактической длительности голосовых, известной после транскрипции.
+// Цена не уменьшается: если Whisper насчитал меньше, чем ffprobe, остаётся предварительная оценка.
+func (q CreditQuote) withAudio(audioSeconds float64) CreditQuote {
+	q.UnmeasuredVoice = 0
+	if audioSeconds <= q.AudioSeconds {
+		return q
+	}
+	q.EstimatedTokens += int(audioSeconds*audioTokensPerSecond) - int(q.AudioSeconds*audioTokensPerSecond)
+	q.AudioSeconds = audioSeconds
+	q.AudioCredits = creditSurcharge(audioSeconds, creditAudioIncluded, creditAudioPerCredit)
+	q.TokenCredits = creditSurcharge(float64(q.EstimatedTokens), creditTokensIncluded, creditTokensPerCredit)
+	q.Credits = min(q.BaseCredits+q.ImageCredits+q.AudioCredits+q.TokenCredits, creditMaxPerRequest)
+	return q
+}
+
+// measureVoice узнаёт длительность голосовых файлов. Файлы, длительность которых узнать
+// не удалось (нет ffprobe или файл не читается), считаются отдельно: надбавка за них доплачивается
+// после транскрипции (см. CreditQuote.withAudio).
+func measureVoice(voicePaths []string) (map[string]time.Duration, int) {
+	durations := make(map[string]time.Duration, len(voicePaths))
+	unmeasured := 0
+	for _, path := range voicePaths {
+		signedURL, err := getVoiceSignedURL(path)
+		if err != nil {
+			unmeasured++
+			continue
+		}
+		duration, ok := probeAudioDuration(signedURL)
+		if !ok {
+			unmeasured++
+			continue
+		}
+		durations[path] = duration
+	}
+	return durations, unmeasured
+}
+
+// quoteChatRequest считает цену хода для запроса к /api/chat. jobResults — результаты готовых
+// задач транскрипции; их длительность уже известна от Whisper. Контекст берётся из ветки,
+// которую продолжит ход: от req.ParentMessageID, если он задан, иначе из активной.
+// Вместе с ценой возвращает измеренные длительности голосовых, чтобы транскрипция не узнавала их заново.
+func quoteChatRequest(persona Persona, req ChatRequest, jobResults []VoiceTranscription) (CreditQuote, map[string]time.Duration, error) {
+	var history []Message
+	var err error
+	if req.ChatID != "" && req.ParentMessageID != "" {
+		history, err = branchMessages(req.ChatID, req.ParentMessageID)
+	} else if req.ChatID != "" {
+		history, err = loadChatHistory(req.ChatID)
+	}
+	if err != nil {
+		return CreditQuote{}, nil, err
+	}
+
+	durations, unmeasured := measureVoice(req.VoicePaths)
+	var audioSeconds float64
+	for _, path := range req.VoicePaths {
+		audioSeconds += durations[path].Seconds()
+	}
+	for _, res := range jobResults {
+		if res.Status == "ok" {
+			audioSeconds += res.Duration
+		}
+	}
+
+	q := quoteCredits(persona, history, req.Prompt, len(req.ImagePaths), audioSeconds)
+	q.UnmeasuredVoice = unmeasured
+	return q, durations, nil
+}
+
+// quoteStoredTurn считает цену повторного ответа на сохранённое сообщение пользователя msg с текстом
+// prompt (при регенерации — его же текст, при правке — новый). Контекст — ветка до msg, вложения
+// и длительность голосовых берутся из msg.
+func quoteStoredTurn(persona Persona, chatID string, msg Message, prompt string) (CreditQuote, error) {
+	var history []Message
+	if msg.ParentID != "" {
+		var err error
+		history, err = branchMessages(chatID, msg.ParentID)
+		if err != nil {
+			return CreditQuote{}, err
+		}
+	}
+	var audioSeconds float64
+	for _, res := range msg.VoiceTranscriptions {
+		if res.Status == "ok" {
+			audioSeconds += res.Duration
+		}
+	}
+	return quoteCredits(persona, history, prompt, len(msg.ImagePaths), audioSeconds), nil
+}
+
+// branchMessages возвращает сообщения ветки, которая заканчивается leafID, без system и tool.
+// Если сообщения нет в чате, возвращает errMessageNotInChat.
+func branchMessages(chatID, leafID string) ([]Message, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE path AS (
+			SELECT id, parent_id FROM messages WHERE id = $2 AND chat_id = $1
+			UNION ALL
+			SELECT m.id, m.parent_id FROM messages m JOIN path p ON m.id = p.parent_id
+		)
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE chat_id = $1 AND id IN (SELECT id FROM path) AND role NOT IN ('system', 'tool')
+		ORDER BY created_at ASC, id ASC
+	`, chatID, leafID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запроса сообщений ветки: %v", err)
+	}
+	defer rows.Close()
+
+	msgs, err := scanMessages(rows, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		// Ветка из одного system-сообщения пуста и для цены, но сам корень должен существовать
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND chat_id = $2)`, leafID, chatID).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка проверки сообщения: %v", err)
+		}
+		if !exists {
+			return nil, errMessageNotInChat
+		}
+	}
+	return msgs, nil
+}
+
+// resolveRequestPersona определяет персону хода и проверяет, что она принимает вложения запроса.
+// Для нового чата персона берётся из запроса, существующий чат продолжает со своей — после проверки владельца.
+// При ошибке пишет её в ответ и возвращает false.
+func resolveRequestPersona(w http.ResponseWriter, req ChatRequest, userID string) (Persona, bool) {
+	var persona Persona
+	if req.ChatID == "" {
+		personaID := req.Persona
+		if personaID == "" {
+			personaID = defaultPersonaID
+		}
+		var ok bool
+		persona, ok = personas.get(personaID, true)
+		if !ok {
+			writeError(w, "unknown_persona", "Неизвестный режим анализа", nil, nil)
+			return persona, false
+		}
+	} else {
+		if !checkChatOwner(w, req.ChatID, userID) {
+			return persona, false
+		}
+		var err error
+		persona, err = chatPersona(req.ChatID)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка получения режима чата", nil, err)
+			return persona, false
+		}
+	}
+	if len(req.ImagePaths) > 0 && !persona.allows(attachmentImage) {
+		writeError(w, "attachment_not_allowed", "Этот режим не принимает изображения", nil, nil)
+		return persona, false
+	}
+	if (len(req.VoicePaths) > 0 || len(req.TranscriptionJobIDs) > 0) && !persona.allows(attachmentVoice) {
+		writeError(w, "attachment_not_allowed", "Этот режим не принимает голосовые сообщения", nil, nil)
+		return persona, false
+	}
+	return persona, true
+}
+
+// chatQuoteHandler (POST /api/chat/quote) принимает то же тело, что и POST /api/chat, и без отправки
+// возвращает, сколько кредитов будет списано за этот ход и хватает ли их.
+func chatQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+	if !utf8.ValidString(req.Prompt) {
+		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	persona, ok := resolveRequestPersona(w, req, userID)
+	if !ok {
+		return
+	}
+
+	var jobResults []VoiceTranscription
+	if len(req.TranscriptionJobIDs) > 0 {
+		results, jobs, err := finishedTranscriptions(userID, req.TranscriptionJobIDs)
+		if errors.Is(err, errTranscriptionsFailed) {
+			writeError(w, "voice_transcription_error", "Ошибка транскрипции голосового сообщения", results, err)
+			return
+		}
+		if err != nil {
+			writeError(w, "transcription_not_ready", "Транскрипция голосового сообщения ещё не готова", jobs, err)
+			return
+		}
+		jobResults = results
+	}
+
+	quote, _, err := quoteChatRequest(persona, req, jobResults)
+	if errors.Is(err, errMessageNotInChat) {
+		writeError(w, "not_found", "Сообщение не найдено", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+
+	err = db.QueryRow(`SELECT count FROM user_credits WHERE user_id = $1`, userID).Scan(&quote.Balance)
+	if err != nil && err != sql.ErrNoRows {
+		writeError(w, "db_error", "Ошибка получения лимита сообщений", nil, err)
+		return
+	}
+	quote.Sufficient = quote.Balance >= quote.Credits
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
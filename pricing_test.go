@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreditSurcharge(t *testing.T) {
+	tests := []struct {
+		name                        string
+		amount, included, perCredit float64
+		want                        int
+	}{
+		{"nothing", 0, 2, 3, 0},
+		{"below included", 1, 2, 3, 0},
+		{"exactly included", 2, 2, 3, 0},
+		{"just over included", 2.01, 2, 3, 1},
+		{"one full portion", 5, 2, 3, 1},
+		{"started second portion", 6, 2, 3, 2},
+		{"audio: 61 seconds", 61, creditAudioIncluded, creditAudioPerCredit, 1},
+		{"audio: 180 seconds", 180, creditAudioIncluded, creditAudioPerCredit, 1},
+		{"audio: 181 seconds", 181, creditAudioIncluded, creditAudioPerCredit, 2},
+		{"negative amount", -10, 2, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := creditSurcharge(tt.amount, tt.included, tt.perCredit); got != tt.want {
+				t.Errorf("creditSurcharge(%v, %v, %v) = %d, want %d", tt.amount, tt.included, tt.perCredit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"abc", 1},
+		{"abcd", 2},
+		{"привет", 2}, // считаются символы, а не байты
+	}
+	for _, tt := range tests {
+		if got := estimateTokens(tt.text); got != tt.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteCredits(t *testing.T) {
+	persona := Persona{CreditCost: 2}
+	longText := strings.Repeat("a", (creditTokensIncluded+1)*tokenRunesRatio)
+	tests := []struct {
+		name         string
+		persona      Persona
+		history      []Message
+		prompt       string
+		images       int
+		audioSeconds float64
+		want         CreditQuote
+	}{
+		{
+			name:    "base price only",
+			persona: persona, prompt: "hi",
+			want: CreditQuote{Credits: 2, BaseCredits: 2, EstimatedTokens: 1},
+		},
+		{
+			name:    "zero cost persona still costs one credit",
+			persona: Persona{}, prompt: "hi",
+			want: CreditQuote{Credits: 1, BaseCredits: 1, EstimatedTokens: 1},
+		},
+		{
+			name:    "included images and audio",
+			persona: persona, images: creditImagesIncluded, audioSeconds: creditAudioIncluded,
+			want: CreditQuote{Credits: 2, BaseCredits: 2, Images: 2, AudioSeconds: 60, EstimatedTokens: 180},
+		},
+		{
+			name:    "image and audio surcharges",
+			persona: persona, images: 6, audioSeconds: 200,
+			want: CreditQuote{Credits: 6, BaseCredits: 2, ImageCredits: 2, AudioCredits: 2, Images: 6, AudioSeconds: 200, EstimatedTokens: 600},
+		},
+		{
+			name:    "long context",
+			persona: persona, history: []Message{{Role: "user", Content: longText}},
+			want: CreditQuote{Credits: 3, BaseCredits: 2, TokenCredits: 1, EstimatedTokens: creditTokensIncluded + 1},
+		},
+		{
+			name:    "system and tool messages are free",
+			persona: persona,
+			history: []Message{{Role: "system", Content: longText}, {Role: "tool", Content: longText}},
+			want:    CreditQuote{Credits: 2, BaseCredits: 2},
+		},
+		{
+			name:    "history voice and screenshots count",
+			persona: persona,
+			history: []Message{{
+				Role:                "user",
+				VoiceTranscriptions: []VoiceTranscription{{Status: "ok", Text: "abcdef"}},
+				ImageTranscripts:    []ScreenshotTranscript{{Lines: []ScreenshotLine{{Speaker: "A", Message: "b"}}}},
+			}},
+			want: CreditQuote{Credits: 2, BaseCredits: 2, EstimatedTokens: 2 + estimateTokens(formatScreenshotTranscripts([]ScreenshotTranscript{{Lines: []ScreenshotLine{{Speaker: "A", Message: "b"}}}}))},
+		},
+		{
+			name:    "capped per request",
+			persona: persona, images: 100, audioSeconds: 3600,
+			want: CreditQuote{Credits: creditMaxPerRequest, BaseCredits: 2, ImageCredits: 33, AudioCredits: 30, TokenCredits: 1,
+				Images: 100, AudioSeconds: 3600, EstimatedTokens: 10800},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quoteCredits(tt.persona, tt.history, tt.prompt, tt.images, tt.audioSeconds)
+			if got != tt.want {
+				t.Errorf("quoteCredits = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreditQuoteWithAudio(t *testing.T) {
+	persona := Persona{CreditCost: 1}
+	tests := []struct {
+		name        string
+		quote       CreditQuote
+		seconds     float64
+		wantCredits int
+		wantAudio   float64
+	}{
+		{"unmeasured file under the included minute", quoteCredits(persona, nil, "", 0, 0), 45, 1, 45},
+		{"unmeasured file adds surcharge", quoteCredits(persona, nil, "", 0, 0), 300, 3, 300},
+		{"measured more than transcribed keeps the quote", quoteCredits(persona, nil, "", 0, 300), 200, 3, 300},
+		{"no voice", quoteCredits(persona, nil, "hi", 0, 0), 0, 1, 0},
+		{"capped per request", quoteCredits(persona, nil, "", 0, 0), 36000, creditMaxPerRequest, 36000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.quote
+			q.UnmeasuredVoice = 1
+			got := q.withAudio(tt.seconds)
+			if got.Credits != tt.wantCredits || got.AudioSeconds != tt.wantAudio || got.UnmeasuredVoice != 0 {
+				t.Errorf("withAudio(%v) = %+v, want %d credits for %v s", tt.seconds, got, tt.wantCredits, tt.wantAudio)
+			}
+			if fresh := quoteCredits(persona, nil, "", 0, tt.wantAudio); tt.wantAudio > tt.quote.AudioSeconds && got.Credits != fresh.Credits {
+				t.Errorf("withAudio(%v) = %d credits, a fresh quote gives %d", tt.seconds, got.Credits, fresh.Credits)
+			}
+		})
+	}
+}
+
+func TestQuoteStoredTurn(t *testing.T) {
+	persona := Persona{CreditCost: 2}
+	// Первое сообщение ветки: без родителя контекст пуст и база не нужна
+	msg := Message{
+		Role:       "user",
+		Content:    "старый текст",
+		ImagePaths: []string{"u/1.png", "u/2.png", "u/3.png"},
+		VoiceTranscriptions: []VoiceTranscription{
+			{Status: "ok", Text: "привет", Duration: 200},
+			{Status: "failed"},
+		},
+	}
+	got, err := quoteStoredTurn(persona, "chat", msg, "новый текст")
+	if err != nil {
+		t.Fatalf("quoteStoredTurn: %v", err)
+	}
+	want := quoteCredits(persona, nil, "новый текст", 3, 200)
+	if got != want {
+		t.Errorf("quoteStoredTurn = %+v, want %+v", got, want)
+	}
+	if got.Credits <= persona.CreditCost {
+		t.Errorf("Credits = %d, want surcharges for images and voice above base %d", got.Credits, persona.CreditCost)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	systemPromptName     = "system"
+	promptReloadInterval = time.Minute
+	legacyPromptFile     = ".prompt"
+)
+
+// promptRegistry — кэш версий промптов из таблицы prompts.
+// Чат ссылается на конкретную версию, поэтому в кэше хранятся все версии, а не только последние.
+type promptRegistry struct {
+	mu     sync.RWMutex
+	byID   map[string]PromptVersion
+	byName map[string]PromptVersion // последняя версия каждого промпта
+}
+
+var prompts = &promptRegistry{
+	byID:   make(map[string]PromptVersion),
+	byName: make(map[string]PromptVersion),
+}
+
+// load перечитывает все версии промптов из базы и заменяет кэш целиком.
+func (p *promptRegistry) load() error {
+	rows, err := db.Query(`
+		SELECT id, name, version, content, created_at
+		FROM prompts
+		ORDER BY name, version
+	`)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки промптов: %v", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[string]PromptVersion)
+	byName := make(map[string]PromptVersion)
+	for rows.Next() {
+		var pv PromptVersion
+		var createdAt time.Time
+		if err := rows.Scan(&pv.ID, &pv.Name, &pv.Version, &pv.Content, &createdAt); err != nil {
+			return fmt.Errorf("ошибка сканирования промпта: %v", err)
+		}
+		pv.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		byID[pv.ID] = pv
+		byName[pv.Name] = pv // строки отсортированы по версии, последняя перезапишет предыдущие
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+
+	p.mu.Lock()
+	p.byID = byID
+	p.byName = byName
+	p.mu.Unlock()
+	return nil
+}
+
+// current возвращает последнюю опубликованную версию промпта.
+func (p *promptRegistry) current(name string) (PromptVersion, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pv, ok := p.byName[name]
+	return pv, ok
+}
+
+// get возвращает версию по id. Версии, опубликованные на другом инстансе после последней
+// перезагрузки кэша, дочитываются из базы.
+func (p *promptRegistry) get(id string) (PromptVersion, error) {
+	p.mu.RLock()
+	pv, ok := p.byID[id]
+	p.mu.RUnlock()
+	if ok {
+		return pv, nil
+	}
+
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT id, name, version, content, created_at FROM prompts WHERE id = $1
+	`, id).Scan(&pv.ID, &pv.Name, &pv.Version, &pv.Content, &createdAt)
+	if err != nil {
+		return pv, fmt.Errorf("ошибка получения промпта %s: %v", id, err)
+	}
+	pv.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	p.put(pv)
+	return pv, nil
+}
+
+func (p *promptRegistry) put(pv PromptVersion) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byID[pv.ID] = pv
+	if latest, ok := p.byName[pv.Name]; !ok || pv.Version > latest.Version {
+		p.byName[pv.Name] = pv
+	}
+}
+
+// publishPrompt сохраняет новую версию промпта и сразу делает её текущей.
+func publishPrompt(name, content string) (PromptVersion, error) {
+	var pv PromptVersion
+	var createdAt time.Time
+	err := db.QueryRow(`
+		INSERT INTO prompts (name, version, content)
+		VALUES ($1, COALESCE((SELECT max(version) FROM prompts WHERE name = $1), 0) + 1, $2)
+		RETURNING id, name, version, content, created_at
+	`, name, content).Scan(&pv.ID, &pv.Name, &pv.Version, &pv.Content, &createdAt)
+	if err != nil {
+		return pv, fmt.Errorf("ошибка публикации промпта: %v", err)
+	}
+	pv.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	prompts.put(pv)
+	return pv, nil
+}
+
+// startPromptRegistry загружает промпты и раз в promptReloadInterval перечитывает их,
+// чтобы версии, опубликованные на других инстансах, подхватывались без перезапуска.
+// Если системного промпта ещё нет, публикует содержимое старого файла .prompt как первую версию.
+func startPromptRegistry() {
+	if err := prompts.load(); err != nil {
+		log.Printf("Ошибка загрузки промптов: %v", err)
+	}
+
+	if _, ok := prompts.current(systemPromptName); !ok {
+		if data, err := os.ReadFile(legacyPromptFile); err == nil && strings.TrimSpace(string(data)) != "" {
+			pv, err := publishPrompt(systemPromptName, string(data))
+			if err != nil {
+				log.Printf("Ошибка переноса %s в базу: %v", legacyPromptFile, err)
+			} else {
+				log.Printf("Файл %s опубликован как промпт %s v%d", legacyPromptFile, pv.Name, pv.Version)
+			}
+		} else {
+			log.Printf("ВНИМАНИЕ: системный промпт не найден, новые чаты создаваться не будут")
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(promptReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := prompts.load(); err != nil {
+				log.Printf("Ошибка перезагрузки промптов: %v", err)
+			}
+		}
+	}()
+}
+
+// loadChatHistory возвращает активную ветку чата для запроса к модели.
+// Чаты, созданные с версией промпта из реестра, хранят пустое system-сообщение (корень дерева
+// сообщений) — его текст подставляется из реестра. Старые чаты хранят текст промпта в самом сообщении.
+// Снимок памяти пользователя, сохранённый при создании чата, дописывается к system-промпту,
+// только пока память у пользователя включена.
+func loadChatHistory(chatID string) ([]Message, error) {
+	messages, err := getChatMessages(chatID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var promptVersionID, memoryContext sql.NullString
+	err = db.QueryRow(`
+		SELECT c.prompt_version_id, CASE WHEN u.memory_enabled THEN c.memory_context END
+		FROM chats c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.id = $1
+	`, chatID).Scan(&promptVersionID, &memoryContext)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения версии промпта: %v", err)
+	}
+
+	var pv PromptVersion
+	if promptVersionID.Valid {
+		pv, err = prompts.get(promptVersionID.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range messages {
+		if messages[i].Role != "system" {
+			continue
+		}
+		if promptVersionID.Valid && messages[i].Content == "" {
+			messages[i].Content = pv.Content
+		}
+		if memoryContext.String != "" {
+			messages[i].Content += "\n\n" + memoryContext.String
+		}
+		break
+	}
+	return messages, nil
+}
+
+// adminPromptsHandler (/api/admin/prompts): GET возвращает все версии, POST публикует новую.
+// Доступ по заголовку Authorization: Bearer $ADMIN_TOKEN.
+func adminPromptsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		prompts.mu.RLock()
+		versions := make([]PromptVersion, 0, len(prompts.byID))
+		for _, pv := range prompts.byID {
+			versions = append(versions, pv)
+		}
+		prompts.mu.RUnlock()
+		sortPromptVersions(versions)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	case http.MethodPost:
+		var req struct {
+			Name    string `json:"name"`
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+			return
+		}
+		if req.Name == "" {
+			req.Name = systemPromptName
+		}
+		if strings.TrimSpace(req.Content) == "" {
+			writeError(w, "empty_prompt", "Текст промпта не может быть пустым", nil, nil)
+			return
+		}
+
+		pv, err := publishPrompt(req.Name, req.Content)
+		if err != nil {
+			writeError(w, "db_error", "Ошибка публикации промпта", nil, err)
+			return
+		}
+		log.Printf("Опубликован промпт %s v%d", pv.Name, pv.Version)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pv)
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+// sortPromptVersions сортирует по имени, затем от новых версий к старым.
+func sortPromptVersions(versions []PromptVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Name != versions[j].Name {
+			return versions[i].Name < versions[j].Name
+		}
+		return versions[i].Version > versions[j].Version
+	})
+}
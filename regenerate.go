@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// regenerateHandler (POST /api/chat/{id}/regenerate) заново генерирует последний ответ ассистента.
+// Цена считается по той же политике, что и у хода (quoteStoredTurn): вложения и контекст отправляются модели заново.
+// Если получить или сохранить новый ответ не удалось, кредиты возвращаются, а активной остаётся прежняя ветка.
+// Новый ответ становится соседней веткой: старый остаётся доступен через /api/chat/{id}/branches.
+// Режим ответа (structured) берётся из тела запроса, а без него — из заменяемого ответа.
+func regenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	// Тело необязательно
+	var req struct {
+		Structured *bool `json:"structured"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+
+	history, err := loadChatHistory(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	lastUser := -1
+	for i, msg := range history {
+		if msg.Role == "user" {
+			lastUser = i
+		}
+	}
+	if lastUser < 0 {
+		writeError(w, "nothing_to_regenerate", "В чате нет сообщений пользователя", nil, nil)
+		return
+	}
+
+	structured, err := turnMode(history[lastUser].ID, req.Structured)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+
+	persona, err := chatPersona(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения режима чата", nil, err)
+		return
+	}
+	quote, err := quoteStoredTurn(persona, chatID, history[lastUser], history[lastUser].Content)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	prevLeaf, err := activeLeaf(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	if !debitOrReject(w, userID, quote) {
+		return
+	}
+	// Пока ответ не сохранён, кредиты возвращаются, а активной остаётся прежняя ветка;
+	// расход на уже выполненные запросы к OpenAI учитывается в любом случае
+	completed := false
+	branched := false
+	meta := replyMeta{Model: persona.Model}
+	defer func() {
+		if completed {
+			return
+		}
+		recordUsage(userID, meta.Usage)
+		refundCredits(userID, quote.Credits)
+		if branched {
+			restoreBranch(chatID, prevLeaf)
+		}
+	}()
+
+	reply, verdict, toolSteps, err := regenerateReply(persona, history[:lastUser+1], structured, toolContext{UserID: userID, ChatID: chatID}, &meta)
+	if err != nil {
+		writeError(w, "openai_error", "Ошибка запроса к OpenAI", nil, err)
+		return
+	}
+
+	branched = true
+	if err := activateBranch(chatID, history[lastUser].ID); err != nil {
+		writeError(w, "db_error", "Ошибка замены ответа ассистента", nil, err)
+		return
+	}
+	messageID, err := saveAssistantMessage(chatID, toolSteps, reply, verdict, meta)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка сохранения сообщения ассистента", nil, err)
+		return
+	}
+	completed = true
+	recordMessageUsage(messageID, userID, meta.Usage)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChatResponse{ChatID: chatID, MessageID: messageID, Response: reply, Verdict: verdict, Credits: quote.Credits})
+}
+
+// editMessageHandler (PUT /api/chat/{id}/messages/{message_id}) создаёт отредактированную копию
+// сообщения пользователя как новую ветку от его родителя и получает на неё ответ ассистента.
+// Исходное сообщение и ответы на него остаются в прежней ветке. Цена — как у хода с новым текстом
+// и вложениями исходного сообщения.
+// Если ответ не получен, активной снова становится прежняя ветка, а правка остаётся соседней.
+// Режим ответа (structured) — как у регенерации: из тела запроса или от ответа на исходное сообщение.
+func editMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	messageID := r.PathValue("message_id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	var req struct {
+		Prompt     string `json:"prompt"`
+		Structured *bool  `json:"structured"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+	if !utf8.ValidString(req.Prompt) {
+		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+		return
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		writeError(w, "empty_prompt", "Текст сообщения не может быть пустым", nil, nil)
+		return
+	}
+
+	original, err := getMessage(chatID, messageID)
+	if err == sql.ErrNoRows {
+		writeError(w, "not_found", "Сообщение не найдено", nil, nil)
+		return
+	} else if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщения", nil, err)
+		return
+	}
+	if original.Role != "user" || original.ParentID == "" {
+		writeError(w, "not_editable", "Редактировать можно только сообщения пользователя", nil, nil)
+		return
+	}
+	structured, err := turnMode(original.ID, req.Structured)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+
+	persona, err := chatPersona(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения режима чата", nil, err)
+		return
+	}
+	quote, err := quoteStoredTurn(persona, chatID, original, req.Prompt)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	prevLeaf, err := activeLeaf(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+	if !debitOrReject(w, userID, quote) {
+		return
+	}
+	completed := false
+	meta := replyMeta{Model: persona.Model}
+	defer func() {
+		if !completed {
+			recordUsage(userID, meta.Usage)
+			refundCredits(userID, quote.Credits)
+			restoreBranch(chatID, prevLeaf)
+		}
+	}()
+
+	if err := forkEditedMessage(chatID, original, req.Prompt); err != nil {
+		writeError(w, "db_error", "Ошибка редактирования сообщения", nil, err)
+		return
+	}
+
+	history, err := loadChatHistory(chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения сообщений", nil, err)
+		return
+	}
+
+	reply, verdict, toolSteps, err := regenerateReply(persona, history, structured, toolContext{UserID: userID, ChatID: chatID}, &meta)
+	if err != nil {
+		writeError(w, "openai_error", "Ошибка запроса к OpenAI", nil, err)
+		return
+	}
+	replyID, err := saveAssistantMessage(chatID, toolSteps, reply, verdict, meta)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка сохранения сообщения ассистента", nil, err)
+		return
+	}
+	completed = true
+	recordMessageUsage(replyID, userID, meta.Usage)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChatResponse{ChatID: chatID, MessageID: replyID, Response: reply, Verdict: verdict, Credits: quote.Credits})
+}
+
+// turnMode определяет, нужен ли ответу на сообщение пользователя структурированный режим: явное
+// значение из запроса или режим последнего ответа на это сообщение (у структурированного есть verdict).
+func turnMode(userMessageID string, requested *bool) (bool, error) {
+	if requested != nil {
+		return *requested, nil
+	}
+	var structured bool
+	err := db.QueryRow(`
+		SELECT verdict IS NOT NULL
+		FROM messages
+		WHERE parent_id = $1 AND role = 'assistant'
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userMessageID).Scan(&structured)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("ошибка получения режима ответа: %v", err)
+	}
+	return structured, nil
+}
+
+// debitOrReject списывает цену регенерации или правки; если кредитов не хватает — пишет ошибку
+// с расчётом цены и возвращает false.
+func debitOrReject(w http.ResponseWriter, userID string, quote CreditQuote) bool {
+	ok, err := debitCredits(userID, quote.Credits)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка обновления счётчика сообщений", nil, err)
+		return false
+	}
+	if !ok {
+		writeError(w, "no_messages", "У вас закончились все доступные сообщения", quote, nil)
+		return false
+	}
+	return true
+}
+
+// getMessage возвращает одно сообщение чата со всеми транскрипциями.
+func getMessage(chatID, messageID string) (Message, error) {
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE id = $1 AND chat_id = $2
+	`, messageID, chatID)
+	if err != nil {
+		return Message{}, fmt.Errorf("ошибка запроса сообщения: %v", err)
+	}
+	defer rows.Close()
+
+	msgs, err := scanMessages(rows, true)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(msgs) == 0 {
+		return Message{}, sql.ErrNoRows
+	}
+	return msgs[0], nil
+}
+
+// forkEditedMessage сохраняет копию сообщения с новым текстом рядом с оригиналом (от того же родителя)
+// и делает её концом активной ветки. Вложения и их транскрипции переносятся из оригинала.
+func forkEditedMessage(chatID string, original Message, content string) error {
+	if err := activateBranch(chatID, original.ParentID); err != nil {
+		return err
+	}
+
+	voiceTranscriptions := original.VoiceTranscriptions
+	if len(voiceTranscriptions) == 0 && original.VoiceTranscription != "" {
+		// Старые сообщения хранят одну склеенную транскрипцию
+		voiceTranscriptions = []VoiceTranscription{{Status: "ok", Text: original.VoiceTranscription}}
+	}
+
+	messageID, err := saveMessageWithTranscription(chatID, "user", content, original.ImagePaths, original.VoicePaths, voiceTranscriptions, original.ImageTranscripts)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE messages SET edited_at = now() WHERE id = $1`, messageID)
+	if err != nil {
+		return fmt.Errorf("ошибка отметки редактирования: %v", err)
+	}
+	return nil
+}
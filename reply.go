@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	chatModel         = "gpt-4o"
+	chatFallbackModel = "gpt-4o-mini"
+	chatMaxTokens     = 1500
+)
+
+// replyMeta — сведения о запросах к модели, из которых получен ответ ассистента.
+type replyMeta struct {
+	Model string     // модель, фактически ответившая; отличается от модели персоны, если сработал резерв
+	Usage usageStats // расход на все запросы ответа: раунды инструментов, исправления JSON
+}
+
+// buildVisionContents собирает контекст модели из истории чата: текст сообщений,
+// кэшированные транскрипции голоса и расшифровки скриншотов.
+func buildVisionContents(messages []Message) []VisionContentItem {
+	var visionContents []VisionContentItem
+	for _, msg := range messages {
+		// Результаты инструментов нужны модели только в том ходе, где она их запросила
+		if msg.Role == "tool" {
+			continue
+		}
+		if strings.HasPrefix(msg.Content, "image:") {
+			path := strings.TrimSpace(strings.TrimPrefix(msg.Content, "image:"))
+			signedURL, err := getSignedURL(path)
+			if err != nil {
+				log.Println("Ошибка получения signed URL из истории:", err)
+				continue
+			}
+			visionContents = append(visionContents, VisionContentItem{
+				Type: "image_url",
+				ImageURL: &VisionImageURL{
+					URL:    signedURL,
+					Detail: "auto",
+				},
+			})
+		} else {
+			visionContents = append(visionContents, VisionContentItem{
+				Type: "text",
+				Text: msg.Content,
+			})
+		}
+
+		// Добавляем кэшированные транскрипции голосовых сообщений из истории
+		if voiceText := messageVoiceText(msg); voiceText != "" {
+			visionContents = append(visionContents, VisionContentItem{
+				Type: "text",
+				Text: voiceText,
+			})
+		}
+
+		// Вместо повторной отправки скриншотов из истории используем их кэшированную расшифровку
+		if len(msg.ImageTranscripts) > 0 {
+			visionContents = append(visionContents, VisionContentItem{
+				Type: "text",
+				Text: formatScreenshotTranscripts(msg.ImageTranscripts),
+			})
+		}
+		// Скриншоты, которые не удалось распознать, отправляем картинкой, иначе модель их не увидит
+		for _, path := range untranscribedImages(msg) {
+			signedURL, err := getSignedURL(path)
+			if err != nil {
+				log.Println("Ошибка получения signed URL из истории:", err)
+				continue
+			}
+			visionContents = append(visionContents, VisionContentItem{
+				Type: "image_url",
+				ImageURL: &VisionImageURL{
+					URL:    signedURL,
+					Detail: "auto",
+				},
+			})
+		}
+	}
+	return visionContents
+}
+
+// buildTurnContents собирает контекст хода: историю ветки и последний ход пользователя,
+// который должен быть последним сообщением history.
+func buildTurnContents(history []Message) ([]VisionContentItem, error) {
+	visionContents := buildVisionContents(history[:len(history)-1])
+	return appendCurrentTurn(visionContents, history[len(history)-1])
+}
+
+// appendCurrentTurn добавляет в контекст текущий ход пользователя: текст, картинки, расшифровку
+// скриншотов и транскрипцию голоса. Расшифровка нужна и при картинках: из неё модель цитирует
+// доказательства, которые проверяет validateStructuredReply.
+func appendCurrentTurn(visionContents []VisionContentItem, msg Message) ([]VisionContentItem, error) {
+	// Добавляем текущий prompt
+	visionContents = append(visionContents, VisionContentItem{
+		Type: "text",
+		Text: msg.Content,
+	})
+
+	// Добавляем картинки из текущего запроса
+	for _, path := range msg.ImagePaths {
+		signedURL, err := getSignedURL(path)
+		if err != nil {
+			return nil, err
+		}
+		visionContents = append(visionContents, VisionContentItem{
+			Type: "image_url",
+			ImageURL: &VisionImageURL{
+				URL:    signedURL,
+				Detail: "auto",
+			},
+		})
+	}
+	if len(msg.ImageTranscripts) > 0 {
+		visionContents = append(visionContents, VisionContentItem{
+			Type: "text",
+			Text: formatScreenshotTranscripts(msg.ImageTranscripts),
+		})
+	}
+
+	// Добавляем транскрипцию текущих голосовых сообщений
+	if voiceText := messageVoiceText(msg); voiceText != "" {
+		visionContents = append(visionContents, VisionContentItem{
+			Type: "text",
+			Text: voiceText,
+		})
+	}
+	return visionContents, nil
+}
+
+// requestPersonaCompletion отправляет запрос с моделью, температурой и лимитом токенов персоны.
+// Если основная модель недоступна (429, 5xx или сетевой сбой), запрос повторяется на резервной.
+func requestPersonaCompletion(persona Persona, req VisionRequest, meta *replyMeta) (*OpenAIResponse, error) {
+	req.Model = persona.Model
+	req.Temperature = persona.Temperature
+	req.MaxTokens = persona.MaxTokens
+
+	openaiResp, err := requestChatCompletion(req)
+	if err != nil && isRetryableError(err) && persona.FallbackModel != "" && persona.FallbackModel != persona.Model {
+		log.Printf("Модель %s недоступна, повторяем запрос на %s: %v", persona.Model, persona.FallbackModel, err)
+		req.Model = persona.FallbackModel
+		openaiResp, err = requestChatCompletion(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta.Model = req.Model
+	meta.Usage.addCompletion(req.Model, req, openaiResp)
+	return openaiResp, nil
+}
+
+// requestAssistantReply отправляет собранный контекст модели персоны и возвращает текст ответа.
+func requestAssistantReply(persona Persona, visionContents []VisionContentItem, meta *replyMeta) (string, error) {
+	openaiResp, err := requestPersonaCompletion(persona, VisionRequest{
+		Messages: []VisionMessage{{
+			Role:    "user",
+			Content: visionContents,
+		}},
+	}, meta)
+	if err != nil {
+		return "", err
+	}
+	return openaiResp.Choices[0].Message.Content, nil
+}
+
+// regenerateReply повторно запрашивает ответ на последний ход истории: с оценкой рисков, если ход
+// был в структурированном режиме, иначе с вызовами инструментов.
+// Последнее сообщение history должно быть сообщением пользователя.
+func regenerateReply(persona Persona, history []Message, structured bool, tc toolContext, meta *replyMeta) (string, *Verdict, []Message, error) {
+	visionContents, err := buildTurnContents(history)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if structured {
+		reply, verdict, err := requestStructuredReply(persona, visionContents, meta)
+		return reply, verdict, nil, err
+	}
+	reply, toolSteps, err := requestReplyWithTools(persona, visionContents, tc, meta)
+	return reply, nil, toolSteps, err
+}
+
+// saveAssistantMessage сохраняет вызовы инструментов и ответ ассистента одной транзакцией, чтобы
+// ход не остался с вызовами без ответа. Ответ сохраняется вместе с оценкой рисков (если есть), моделью
+// и версией промпта, которые его сгенерировали, — по ним группируются оценки ответов.
+func saveAssistantMessage(chatID string, toolSteps []Message, content string, verdict *Verdict, meta replyMeta) (string, error) {
+	var verdictJSON interface{}
+	if verdict != nil {
+		data, err := json.Marshal(verdict)
+		if err != nil {
+			return "", fmt.Errorf("ошибка кодирования оценки рисков: %v", err)
+		}
+		verdictJSON = string(data)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, step := range toolSteps {
+		data, err := json.Marshal(step.ToolCalls[0])
+		if err != nil {
+			return "", fmt.Errorf("ошибка кодирования вызова инструмента: %v", err)
+		}
+		if _, err := appendReplyMessage(tx, chatID, "tool", step.Content, "", nil, string(data)); err != nil {
+			return "", fmt.Errorf("ошибка сохранения вызова инструмента: %v", err)
+		}
+	}
+	messageID, err := appendReplyMessage(tx, chatID, "assistant", content, meta.Model, verdictJSON, nil)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сохранения сообщения: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("ошибка сохранения сообщения: %v", err)
+	}
+	return messageID, nil
+}
+
+// appendReplyMessage добавляет сообщение модели (ответ или вызов инструмента) в конец активной ветки.
+// Как saveMessageWithTranscription, но модель, версия промпта, оценка и вызов пишутся тем же INSERT.
+func appendReplyMessage(tx *sql.Tx, chatID, role, content, model string, verdict, toolCall interface{}) (string, error) {
+	var messageID string
+	err := tx.QueryRow(`
+		WITH inserted AS (
+			INSERT INTO messages (chat_id, parent_id, role, content, search_config, search_vector,
+			                      model, prompt_version_id, verdict, tool_call)
+			SELECT c.id, c.active_leaf_id, $2, $3, c.search_config, to_tsvector(c.search_config, $3),
+			       NULLIF($4, ''), CASE WHEN $2 = 'assistant' THEN c.prompt_version_id END, $5, $6
+			FROM chats c
+			WHERE c.id = $1
+			RETURNING id
+		)
+		UPDATE chats SET active_leaf_id = (SELECT id FROM inserted)
+		WHERE id = $1
+		RETURNING active_leaf_id
+	`, chatID, role, content, model, verdict, toolCall).Scan(&messageID)
+	return messageID, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	screenshotOCRModel   = "gpt-4o"
+	screenshotOCRWorkers = 4
+)
+
+const screenshotOCRPrompt = `You are an OCR engine for chat screenshots.
+Extract every chat message visible on the screenshot in the order it appears.
+Return ONLY a JSON object of the form:
+{"lines": [{"speaker": "...", "message": "...", "timestamp": "..."}]}
+- "speaker": the sender name as shown, or "me" for outgoing bubbles and "them" for incoming ones if no name is visible;
+- "message": the exact message text, without translation or corrections;
+- "timestamp": the time shown next to the message, or an empty string if there is none.
+If the image is not a chat screenshot, return {"lines": []}.`
+
+// extractScreenshotTranscripts параллельно распознаёт текст переписки на каждом скриншоте
+// и возвращает расход на распознавание. Скриншоты, которые не удалось распознать, пропускаются:
+// в следующих ходах вместо расшифровки модели отправляется сама картинка (см. buildVisionContents).
+func extractScreenshotTranscripts(imagePaths []string) ([]ScreenshotTranscript, usageStats) {
+	results := make([]*ScreenshotTranscript, len(imagePaths))
+	usages := make([]usageStats, len(imagePaths))
+	sem := make(chan struct{}, screenshotOCRWorkers)
+	var wg sync.WaitGroup
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			signedURL, err := getSignedURL(path)
+			if err != nil {
+				log.Printf("Ошибка получения signed URL для скриншота %s: %v", path, err)
+				return
+			}
+			lines, err := extractScreenshotFromURL(signedURL, &usages[i])
+			if err != nil {
+				log.Printf("Ошибка распознавания скриншота %s: %v", path, err)
+				return
+			}
+			results[i] = &ScreenshotTranscript{Path: path, Number: i + 1, Lines: lines}
+		}(i, path)
+	}
+	wg.Wait()
+
+	var transcripts []ScreenshotTranscript
+	var usage usageStats
+	for i, t := range results {
+		usage.merge(usages[i])
+		if t != nil {
+			transcripts = append(transcripts, *t)
+		}
+	}
+	return transcripts, usage
+}
+
+// untranscribedImages возвращает картинки сообщения, для которых нет расшифровки.
+func untranscribedImages(msg Message) []string {
+	done := make(map[string]bool, len(msg.ImageTranscripts))
+	for _, t := range msg.ImageTranscripts {
+		done[t.Path] = true
+	}
+	var paths []string
+	for _, path := range msg.ImagePaths {
+		if !done[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// extractScreenshotFromURL просит модель вернуть структурированную расшифровку скриншота.
+func extractScreenshotFromURL(imageURL string, usage *usageStats) ([]ScreenshotLine, error) {
+	visionReq := VisionRequest{
+		Model: screenshotOCRModel,
+		Messages: []VisionMessage{{
+			Role: "user",
+			Content: []VisionContentItem{
+				{Type: "text", Text: screenshotOCRPrompt},
+				{Type: "image_url", ImageURL: &VisionImageURL{URL: imageURL, Detail: "high"}},
+			},
+		}},
+		ResponseFormat: &ResponseFormat{Type: "json_object"},
+	}
+
+	openaiResp, err := requestChatCompletion(visionReq)
+	if err != nil {
+		return nil, err
+	}
+	usage.addCompletion(visionReq.Model, visionReq, openaiResp)
+
+	var result struct {
+		Lines []ScreenshotLine `json:"lines"`
+	}
+	if err := json.Unmarshal([]byte(openaiResp.Choices[0].Message.Content), &result); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга расшифровки скриншота: %v", err)
+	}
+	return result.Lines, nil
+}
+
+// formatScreenshotTranscripts превращает сохранённые расшифровки в текст для контекста модели.
+func formatScreenshotTranscripts(transcripts []ScreenshotTranscript) string {
+	var sb strings.Builder
+	for i, t := range transcripts {
+		number := t.Number
+		if number == 0 {
+			number = i + 1 // расшифровки до появления номера сохранялись без пропусков
+		}
+		fmt.Fprintf(&sb, "Screenshot %d transcript:\n", number)
+		for _, line := range t.Lines {
+			if line.Timestamp != "" {
+				fmt.Fprintf(&sb, "[%s] ", line.Timestamp)
+			}
+			fmt.Fprintf(&sb, "%s: %s\n", line.Speaker, line.Message)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
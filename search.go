@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	searchMaxMessages      = 100
+	searchMaxChats         = 20
+	searchMaxMatchesInChat = 3
+	searchMaxQueryRunes    = 200
+
+	// Границы совпадений в ts_headline. Символы из области частного использования не встречаются
+	// в обычном тексте и всё равно вырезаются из него, поэтому после экранирования HTML
+	// их можно безопасно заменить на <b></b>.
+	searchHighlightStart = "\uE000"
+	searchHighlightStop  = "\uE001"
+)
+
+var searchHighlightMarkers = strings.NewReplacer(searchHighlightStart, "<b>", searchHighlightStop, "</b>")
+
+// searchConfigs сопоставляет ISO-639-1 код языка с конфигурацией полнотекстового поиска PostgreSQL.
+var searchConfigs = map[string]string{
+	"ar": "arabic",
+	"da": "danish",
+	"de": "german",
+	"en": "english",
+	"es": "spanish",
+	"fi": "finnish",
+	"fr": "french",
+	"hu": "hungarian",
+	"id": "indonesian",
+	"it": "italian",
+	"nl": "dutch",
+	"no": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"sv": "swedish",
+	"tr": "turkish",
+}
+
+// setChatSearchLanguage запоминает язык чата, чтобы новые сообщения индексировались с подходящим стеммингом.
+func setChatSearchLanguage(chatID, language string) error {
+	config, ok := searchConfigs[normalizeLanguageHint(language)]
+	if !ok {
+		return nil
+	}
+	_, err := db.Exec(`UPDATE chats SET search_config = $2::regconfig WHERE id = $1`, chatID, config)
+	return err
+}
+
+// searchHandler ищет по тексту сообщений и транскрипциям голосовых в чатах пользователя.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeError(w, "missing_query", "Параметр q обязателен", nil, nil)
+		return
+	}
+	if !utf8.ValidString(q) {
+		writeError(w, "invalid_encoding", "Текст содержит некорректную кодировку UTF-8", nil, nil)
+		return
+	}
+	q = truncateUTF8(q, searchMaxQueryRunes)
+
+	results, err := searchMessages(userID, q)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка поиска", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// searchMessages находит сообщения по запросу и группирует их по чатам в порядке релевантности.
+// Запрос разбирается с конфигурацией языка каждого сообщения.
+func searchMessages(userID, q string) ([]SearchResult, error) {
+	rows, err := db.Query(`
+		WITH matched AS (
+			SELECT m.id, m.chat_id, c.title, m.role, m.created_at, m.search_config,
+			       translate(m.content || ' ' || COALESCE(m.voice_transcription, '') || ' ' || COALESCE(
+			           (SELECT string_agg(v->>'text', ' ') FROM jsonb_array_elements(m.voice_transcriptions) v), ''
+			       ), $4 || $5, '') AS body,
+			       websearch_to_tsquery(m.search_config, $2) AS query,
+			       m.search_vector
+			FROM messages m
+			JOIN chats c ON c.id = m.chat_id
+			WHERE c.user_id = $1
+			  AND c.deleted_at IS NULL
+			  AND m.role NOT IN ('system', 'tool')
+			  AND m.superseded_at IS NULL
+			  AND m.search_vector @@ websearch_to_tsquery(m.search_config, $2)
+		)
+		SELECT matched.id, matched.chat_id, matched.title, matched.role, matched.created_at,
+		       ts_headline(matched.search_config, matched.body, matched.query,
+		                   'StartSel="' || $4 || '", StopSel="' || $5 || '", MaxFragments=2, MaxWords=20, MinWords=5')
+		FROM matched
+		ORDER BY ts_rank(matched.search_vector, matched.query) DESC, matched.created_at DESC
+		LIMIT $3
+	`, userID, q, searchMaxMessages, searchHighlightStart, searchHighlightStop)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка поиска сообщений: %v", err)
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	chatIndex := make(map[string]int)
+	for rows.Next() {
+		var match SearchMatch
+		var chatID string
+		var title sql.NullString
+		var createdAt time.Time
+		if err := rows.Scan(&match.MessageID, &chatID, &title, &match.Role, &createdAt, &match.Snippet); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования результата поиска: %v", err)
+		}
+		match.Snippet = highlightSnippet(match.Snippet)
+		match.Timestamp = createdAt.Format("2006-01-02T15:04:05Z")
+
+		i, ok := chatIndex[chatID]
+		if !ok {
+			if len(results) >= searchMaxChats {
+				continue
+			}
+			result := SearchResult{ChatID: chatID}
+			if title.Valid {
+				result.Title = title.String
+			}
+			results = append(results, result)
+			i = len(results) - 1
+			chatIndex[chatID] = i
+		}
+		if len(results[i].Matches) < searchMaxMatchesInChat {
+			results[i].Matches = append(results[i].Matches, match)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return results, nil
+}
+
+// highlightSnippet экранирует текст фрагмента из ts_headline и только затем размечает совпадения
+// тегами <b></b>, чтобы HTML из сообщений пользователя не попал в разметку.
+func highlightSnippet(headline string) string {
+	return searchHighlightMarkers.Replace(html.EscapeString(headline))
+}
+
+// plainSnippet возвращает исходный текст фрагмента, размеченного highlightSnippet.
+func plainSnippet(snippet string) string {
+	return html.UnescapeString(strings.NewReplacer("<b>", "", "</b>", "").Replace(snippet))
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestHighlightSnippet(t *testing.T) {
+	s, e := searchHighlightStart, searchHighlightStop
+	tests := []struct {
+		name      string
+		headline  string
+		want      string
+		wantPlain string
+	}{
+		{"no matches", "просто текст", "просто текст", "просто текст"},
+		{"one match", "он " + s + "игнорирует" + e + " меня", "он <b>игнорирует</b> меня", "он игнорирует меня"},
+		{"user html", "<script>" + s + "alert" + e + "</script>", "&lt;script&gt;<b>alert</b>&lt;/script&gt;", "<script>alert</script>"},
+		{"user bold tags", "<b>" + s + "важно" + e + "</b>", "&lt;b&gt;<b>важно</b>&lt;/b&gt;", "<b>важно</b>"},
+		{"entities", "Tom & " + s + "Jerry" + e + " &amp;", "Tom &amp; <b>Jerry</b> &amp;amp;", "Tom & Jerry &amp;"},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := highlightSnippet(tt.headline)
+			if got != tt.want {
+				t.Errorf("highlightSnippet = %q, want %q", got, tt.want)
+			}
+			if plain := plainSnippet(got); plain != tt.wantPlain {
+				t.Errorf("plainSnippet = %q, want %q", plain, tt.wantPlain)
+			}
+		})
+	}
+}
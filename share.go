@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	shareDefaultTTL = 7 * 24 * time.Hour
+	shareMaxTTL     = 90 * 24 * time.Hour
+	shareTokenBytes = 32
+)
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Chat{{end}}</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; max-width: 720px; margin: 0 auto; padding: 16px; color: #222; }
+.msg { margin: 16px 0; padding: 12px 16px; border-radius: 12px; white-space: pre-wrap; }
+.user { background: #e8f0fe; }
+.assistant { background: #f4f4f4; }
+.meta { font-size: 12px; color: #888; margin-bottom: 6px; }
+.voice { color: #555; font-style: italic; margin-top: 8px; }
+img { max-width: 100%; border-radius: 8px; margin-top: 8px; display: block; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}Chat{{end}}</h1>
+{{range .Messages}}
+<div class="msg {{.Role}}">
+<div class="meta">{{if eq .Role "user"}}User{{else}}Assistant{{end}} · {{.Timestamp}}</div>
+{{.Content}}
+{{if .VoiceTranscription}}<div class="voice">🎙 {{.VoiceTranscription}}</div>{{end}}
+{{range .ImageURLs}}<img src="{{.}}" alt="">{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// shareHandler (/api/chats/{id}/share): POST создаёт ссылку только для чтения, GET возвращает ссылки чата.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleShareList(w, chatID)
+	case http.MethodPost:
+		handleShareCreate(w, r, chatID)
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+func handleShareCreate(w http.ResponseWriter, r *http.Request, chatID string) {
+	var req struct {
+		ExpiresInHours int  `json:"expires_in_hours"`
+		RedactImages   bool `json:"redact_images"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+			return
+		}
+	}
+
+	ttl := shareDefaultTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl > shareMaxTTL {
+		ttl = shareMaxTTL
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		writeError(w, "token_error", "Ошибка создания ссылки", nil, err)
+		return
+	}
+
+	var share ChatShare
+	var createdAt, expiresAt time.Time
+	err = db.QueryRow(`
+		INSERT INTO chat_shares (chat_id, token, redact_images, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, token, redact_images, created_at, expires_at
+	`, chatID, token, req.RedactImages, time.Now().Add(ttl)).Scan(&share.ID, &share.Token, &share.RedactImages, &createdAt, &expiresAt)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка создания ссылки", nil, err)
+		return
+	}
+	share.URL = shareURL(share.Token)
+	share.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	share.ExpiresAt = expiresAt.Format("2006-01-02T15:04:05Z")
+	share.Active = true
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(share)
+}
+
+func handleShareList(w http.ResponseWriter, chatID string) {
+	rows, err := db.Query(`
+		SELECT id, token, redact_images, created_at, expires_at, revoked_at
+		FROM chat_shares
+		WHERE chat_id = $1
+		ORDER BY created_at DESC
+	`, chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения ссылок", nil, err)
+		return
+	}
+	defer rows.Close()
+
+	shares := []ChatShare{}
+	for rows.Next() {
+		var share ChatShare
+		var createdAt, expiresAt time.Time
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&share.ID, &share.Token, &share.RedactImages, &createdAt, &expiresAt, &revokedAt); err != nil {
+			writeError(w, "db_error", "Ошибка чтения ссылок", nil, err)
+			return
+		}
+		share.URL = shareURL(share.Token)
+		share.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		share.ExpiresAt = expiresAt.Format("2006-01-02T15:04:05Z")
+		if revokedAt.Valid {
+			share.RevokedAt = revokedAt.Time.Format("2006-01-02T15:04:05Z")
+		}
+		share.Active = !revokedAt.Valid && expiresAt.After(time.Now())
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, "db_error", "Ошибка чтения ссылок", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// shareRevokeHandler (DELETE /api/chats/{id}/share/{share_id}) отзывает ссылку.
+func shareRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	chatID := r.PathValue("id")
+	if !checkChatOwner(w, chatID, userID) {
+		return
+	}
+
+	res, err := db.Exec(`
+		UPDATE chat_shares
+		SET revoked_at = COALESCE(revoked_at, now())
+		WHERE id = $1 AND chat_id = $2
+	`, r.PathValue("share_id"), chatID)
+	if err != nil {
+		writeError(w, "db_error", "Ошибка отзыва ссылки", nil, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, "not_found", "Ссылка не найдена", nil, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publicShareHandler (GET /s/{token}) показывает чат по ссылке без авторизации.
+// ?format=json возвращает те же данные в JSON.
+func publicShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var chatID string
+	var redactImages bool
+	err := db.QueryRow(`
+		SELECT s.chat_id, s.redact_images
+		FROM chat_shares s
+		JOIN chats c ON c.id = s.chat_id
+		WHERE s.token = $1
+		  AND s.revoked_at IS NULL
+		  AND s.expires_at > now()
+		  AND c.deleted_at IS NULL
+	`, r.PathValue("token")).Scan(&chatID, &redactImages)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Ссылка недействительна или срок её действия истёк", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("publicShareHandler error:", err)
+		http.Error(w, "Ошибка базы данных", http.StatusInternalServerError)
+		return
+	}
+
+	export, err := loadChatExport(chatID, !redactImages)
+	if err != nil {
+		log.Println("publicShareHandler error:", err)
+		http.Error(w, "Ошибка получения чата", http.StatusInternalServerError)
+		return
+	}
+	// Внутренний id чата по публичной ссылке не раскрываем
+	export.ChatID = ""
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := sharePageTemplate.Execute(w, export); err != nil {
+		log.Println("publicShareHandler template error:", err)
+	}
+}
+
+// newShareToken возвращает случайный токен длиной 256 бит.
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareURL строит публичную ссылку; базовый адрес задаётся PUBLIC_BASE_URL.
+func shareURL(token string) string {
+	return strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/") + "/s/" + token
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	voiceBucketName      = "redflagged-voices"
+	storageDeleteBatch   = 100
+	chatMediaPurgeWorker = 2
+)
+
+// deleteStorageObjects удаляет объекты из бакета Supabase Storage пачками.
+func deleteStorageObjects(bucket string, paths []string) error {
+	baseURL := os.Getenv("SUPABASE_URL") + "/storage/v1"
+	secret := os.Getenv("SUPABASE_SERVICE_ROLE")
+	if baseURL == "" || secret == "" || bucket == "" {
+		return fmt.Errorf("не заданы переменные окружения SUPABASE_URL / SERVICE_ROLE / BUCKET_NAME")
+	}
+
+	for start := 0; start < len(paths); start += storageDeleteBatch {
+		end := start + storageDeleteBatch
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		prefixes := make([]string, 0, end-start)
+		for _, path := range paths[start:end] {
+			prefixes = append(prefixes, strings.TrimPrefix(path, "/"))
+		}
+		jsonData, err := json.Marshal(map[string]interface{}{"prefixes": prefixes})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/object/%s", baseURL, bucket), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+secret)
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("supabase вернул %d: %s", resp.StatusCode, string(body))
+		}
+	}
+	return nil
+}
+
+// purgeChatMedia удаляет картинки и голосовые файлы удалённого чата и отмечает чат как очищенный.
+func purgeChatMedia(chatID string) error {
+	var imagePaths, voicePaths []string
+	err := db.QueryRow(`
+		SELECT COALESCE(array_agg(p) FILTER (WHERE kind = 'image'), '{}'),
+		       COALESCE(array_agg(p) FILTER (WHERE kind = 'voice'), '{}')
+		FROM (
+			SELECT unnest(image_paths) AS p, 'image' AS kind FROM messages WHERE chat_id = $1
+			UNION
+			SELECT unnest(voice_paths) AS p, 'voice' AS kind FROM messages WHERE chat_id = $1
+		) media
+	`, chatID).Scan(pq.Array(&imagePaths), pq.Array(&voicePaths))
+	if err != nil {
+		return fmt.Errorf("ошибка получения файлов чата: %v", err)
+	}
+
+	if err := deleteStorageObjects(os.Getenv("SUPABASE_BUCKET_NAME"), imagePaths); err != nil {
+		return fmt.Errorf("ошибка удаления картинок: %v", err)
+	}
+	if err := deleteStorageObjects(voiceBucketName, voicePaths); err != nil {
+		return fmt.Errorf("ошибка удаления голосовых сообщений: %v", err)
+	}
+
+	_, err = db.Exec(`UPDATE chats SET media_deleted_at = now() WHERE id = $1`, chatID)
+	if err != nil {
+		return fmt.Errorf("ошибка отметки очистки чата: %v", err)
+	}
+	log.Printf("Удалены файлы чата %s: картинок %d, голосовых %d", chatID, len(imagePaths), len(voicePaths))
+	return nil
+}
+
+// schedulePendingChatPurges доочищает чаты, удалённые до перезапуска сервера.
+func schedulePendingChatPurges() {
+	rows, err := db.Query(`SELECT id FROM chats WHERE deleted_at IS NOT NULL AND media_deleted_at IS NULL`)
+	if err != nil {
+		log.Printf("Ошибка загрузки удалённых чатов: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var chatIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Ошибка чтения удалённого чата: %v", err)
+			return
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	if len(chatIDs) == 0 {
+		return
+	}
+
+	go func() {
+		sem := make(chan struct{}, chatMediaPurgeWorker)
+		for _, id := range chatIDs {
+			sem <- struct{}{}
+			go func(id string) {
+				defer func() { <-sem }()
+				if err := purgeChatMedia(id); err != nil {
+					log.Printf("Ошибка очистки чата %s: %v", id, err)
+				}
+			}(id)
+		}
+	}()
+}
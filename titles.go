@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	chatTitleModel       = "gpt-4o-mini"
+	chatTitleSourceRunes = 2000
+	chatTitleReplyRunes  = 1000
+)
+
+const chatTitlePrompt = `Write a short descriptive title (3 to 6 words) for the conversation below.
+Use the same language as the user's message. Do not use quotes, emojis or a trailing period.
+Return only the title.`
+
+// titleSourceText собирает текст первого сообщения пользователя вместе с транскрипциями вложений.
+func titleSourceText(prompt, voiceTranscription string, imageTranscripts []ScreenshotTranscript) string {
+	var parts []string
+	if prompt != "" {
+		parts = append(parts, prompt)
+	}
+	if voiceTranscription != "" {
+		parts = append(parts, voiceTranscription)
+	}
+	if len(imageTranscripts) > 0 {
+		parts = append(parts, formatScreenshotTranscripts(imageTranscripts))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// generateChatTitle просит модель придумать название чата после первого ответа ассистента.
+// Название обновляется, только если пользователь не успел переименовать чат сам.
+// Запрос не списывает кредиты пользователя; ошибки только логируются.
+func generateChatTitle(userID, chatID, currentTitle, userText, assistantReply string) {
+	if strings.TrimSpace(userText) == "" && strings.TrimSpace(assistantReply) == "" {
+		return
+	}
+
+	conversation := "User: " + truncateUTF8(userText, chatTitleSourceRunes) +
+		"\n\nAssistant: " + truncateUTF8(assistantReply, chatTitleReplyRunes)
+
+	titleReq := VisionRequest{
+		Model: chatTitleModel,
+		Messages: []VisionMessage{
+			{Role: "system", Content: []VisionContentItem{{Type: "text", Text: chatTitlePrompt}}},
+			{Role: "user", Content: []VisionContentItem{{Type: "text", Text: conversation}}},
+		},
+	}
+	openaiResp, err := requestChatCompletion(titleReq)
+	if err != nil {
+		log.Printf("Ошибка генерации названия чата %s: %v", chatID, err)
+		return
+	}
+	var usage usageStats
+	usage.addCompletion(titleReq.Model, titleReq, openaiResp)
+	recordUsage(userID, usage)
+
+	title := strings.TrimSpace(openaiResp.Choices[0].Message.Content)
+	title = strings.Trim(title, "\"'«»“”.")
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return
+	}
+	title = truncateUTF8(title, chatTitleMaxRunes)
+
+	_, err = db.Exec(`UPDATE chats SET title = $2 WHERE id = $1 AND title = $3`, chatID, title, currentTitle)
+	if err != nil {
+		log.Printf("Ошибка сохранения названия чата %s: %v", chatID, err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	toolMaxIterations    = 4
+	toolMaxCallsPerRound = 5 // лишние параллельные вызовы в одном ответе модели не выполняются
+	toolResultMaxRunes   = 4000
+	toolLookupMaxChats   = 5
+	toolLookupMaxLength  = 200
+)
+
+// toolContext — данные запроса, доступные инструментам. Инструменты видят только данные этого пользователя.
+type toolContext struct {
+	UserID string
+	ChatID string
+}
+
+// chatTool — инструмент, который модель может вызвать во время ответа.
+type chatTool struct {
+	Description string
+	Parameters  string // JSON Schema аргументов
+	Run         func(tc toolContext, args json.RawMessage) (interface{}, error)
+}
+
+// chatTools — реестр инструментов; имя — ключ, под которым модель вызывает инструмент.
+var chatTools = map[string]chatTool{
+	"lookup_previous_chats": {
+		Description: "Search the user's previous chats for a person, topic or phrase. Use it when the user refers to something discussed before.",
+		Parameters:  `{"type":"object","properties":{"query":{"type":"string","description":"Words to search for, e.g. a name"}},"required":["query"]}`,
+		Run:         runLookupPreviousChats,
+	},
+	"get_user_profile": {
+		Description: "Get the user's account info: remaining messages, whether they bought a pack, account age and number of chats.",
+		Parameters:  `{"type":"object","properties":{}}`,
+		Run:         runGetUserProfile,
+	},
+	"compute_response_time_stats": {
+		Description: "Compute how fast each participant replies in the chat screenshots of this conversation: message counts and average, median and longest reply delays per speaker.",
+		Parameters:  `{"type":"object","properties":{}}`,
+		Run:         runComputeResponseTimeStats,
+	},
+}
+
+// toolDefinitions возвращает описание инструментов в формате OpenAI, отсортированное по имени.
+func toolDefinitions() []ToolDefinition {
+	names := make([]string, 0, len(chatTools))
+	for name := range chatTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]ToolDefinition, 0, len(names))
+	for _, name := range names {
+		t := chatTools[name]
+		defs = append(defs, ToolDefinition{
+			Type: "function",
+			Function: ToolFunctionDefinition{
+				Name:        name,
+				Description: t.Description,
+				Parameters:  json.RawMessage(t.Parameters),
+			},
+		})
+	}
+	return defs
+}
+
+// requestReplyWithTools запрашивает ответ модели, выполняя вызовы инструментов и возвращая модели их
+// результаты, пока она не ответит текстом. После toolMaxIterations раундов инструменты отключаются,
+// и модель обязана ответить с тем, что уже есть. За раунд выполняется не больше toolMaxCallsPerRound
+// вызовов, на остальные модель получает ошибку. Возвращает ответ и выполненные вызовы по порядку.
+func requestReplyWithTools(persona Persona, visionContents []VisionContentItem, tc toolContext, meta *replyMeta) (string, []Message, error) {
+	messages := []VisionMessage{{Role: "user", Content: visionContents}}
+	var steps []Message
+
+	for iteration := 0; ; iteration++ {
+		req := VisionRequest{
+			Messages: messages,
+			Tools:    toolDefinitions(),
+		}
+		if iteration >= toolMaxIterations {
+			req.ToolChoice = "none"
+		}
+
+		openaiResp, err := requestPersonaCompletion(persona, req, meta)
+		if err != nil {
+			return "", steps, err
+		}
+		reply := openaiResp.Choices[0].Message
+		if len(reply.ToolCalls) == 0 || iteration >= toolMaxIterations {
+			return reply.Content, steps, nil
+		}
+
+		messages = append(messages, VisionMessage{Role: "assistant", ToolCalls: reply.ToolCalls})
+		for i, call := range reply.ToolCalls {
+			// OpenAI ждёт ответ на каждый tool_call_id, поэтому лишние вызовы получают ошибку, а не пропускаются
+			result := `{"error": "too many tool calls in one turn, call fewer tools at once"}`
+			if i < toolMaxCallsPerRound {
+				result = executeToolCall(call, tc)
+			}
+			messages = append(messages, VisionMessage{
+				Role:       "tool",
+				ToolCallID: call.ID,
+				Content:    []VisionContentItem{{Type: "text", Text: result}},
+			})
+			steps = append(steps, Message{Role: "tool", Content: result, ToolCalls: []ToolCall{call}})
+		}
+	}
+}
+
+// executeToolCall выполняет один вызов и возвращает результат как текст для модели.
+// Ошибки тоже возвращаются модели, чтобы она могла ответить без этих данных.
+func executeToolCall(call ToolCall, tc toolContext) string {
+	tool, ok := chatTools[call.Function.Name]
+	if !ok {
+		return `{"error": "unknown tool"}`
+	}
+
+	args := json.RawMessage(call.Function.Arguments)
+	if len(strings.TrimSpace(call.Function.Arguments)) == 0 {
+		args = json.RawMessage(`{}`)
+	}
+
+	result, err := tool.Run(tc, args)
+	if err != nil {
+		log.Printf("Ошибка инструмента %s в чате %s: %v", call.Function.Name, tc.ChatID, err)
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(data)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return `{"error": "failed to encode result"}`
+	}
+	return truncateUTF8(string(data), toolResultMaxRunes)
+}
+
+func runLookupPreviousChats(tc toolContext, args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	query := truncateUTF8(strings.TrimSpace(params.Query), searchMaxQueryRunes)
+	if query == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+
+	results, err := searchMessages(tc.UserID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		Title    string   `json:"title"`
+		Date     string   `json:"date"`
+		Snippets []string `json:"snippets"`
+	}
+	chats := []found{}
+	for _, r := range results {
+		if r.ChatID == tc.ChatID {
+			continue
+		}
+		f := found{Title: r.Title}
+		for _, m := range r.Matches {
+			if f.Date == "" {
+				f.Date = m.Timestamp
+			}
+			f.Snippets = append(f.Snippets, truncateUTF8(plainSnippet(m.Snippet), toolLookupMaxLength))
+		}
+		chats = append(chats, f)
+		if len(chats) >= toolLookupMaxChats {
+			break
+		}
+	}
+	return map[string]interface{}{"chats": chats}, nil
+}
+
+func runGetUserProfile(tc toolContext, _ json.RawMessage) (interface{}, error) {
+	var profile struct {
+		MessagesLeft int    `json:"messages_left"`
+		IsUsingPaid  bool   `json:"is_using_paid"`
+		MemberSince  string `json:"member_since"`
+		ChatCount    int    `json:"chat_count"`
+	}
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT u.created_at, COALESCE(c.count, 0), COALESCE(c.is_using_paid, false),
+		       (SELECT count(*) FROM chats WHERE user_id = u.id AND deleted_at IS NULL)
+		FROM users u
+		LEFT JOIN user_credits c ON c.user_id = u.id
+		WHERE u.id = $1
+	`, tc.UserID).Scan(&createdAt, &profile.MessagesLeft, &profile.IsUsingPaid, &profile.ChatCount)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения профиля: %v", err)
+	}
+	profile.MemberSince = createdAt.Format("2006-01-02")
+	return profile, nil
+}
+
+// runComputeResponseTimeStats считает задержки ответов по расшифровкам скриншотов активной ветки чата.
+// Ответом считается первое сообщение собеседника после сообщения другого участника.
+func runComputeResponseTimeStats(tc toolContext, _ json.RawMessage) (interface{}, error) {
+	msgs, err := getChatMessages(tc.ChatID, true)
+	if err != nil {
+		return nil, err
+	}
+	var lines []ScreenshotLine
+	for _, m := range msgs {
+		for _, t := range m.ImageTranscripts {
+			lines = append(lines, t.Lines...)
+		}
+	}
+	return responseTimeStats(lines), nil
+}
+
+type speakerStats struct {
+	Messages           int     `json:"messages"`
+	Replies            int     `json:"replies"`
+	AvgReplyMinutes    float64 `json:"avg_reply_minutes,omitempty"`
+	MedianReplyMinutes float64 `json:"median_reply_minutes,omitempty"`
+	MaxReplyMinutes    float64 `json:"max_reply_minutes,omitempty"`
+}
+
+// screenshotTimeLayouts — форматы времени, которые встречаются на скриншотах мессенджеров.
+var screenshotTimeLayouts = []string{
+	"15:04", "15:04:05", "3:04 PM", "3:04PM", "03:04 PM",
+	"2006-01-02 15:04", "02.01.2006 15:04", "02.01.2006, 15:04", "1/2/06, 3:04 PM", "1/2/2006, 3:04 PM",
+	"Jan 2, 3:04 PM", "Jan 2, 15:04", "2 Jan 15:04",
+}
+
+var screenshotTimePattern = regexp.MustCompile(`\s+`)
+
+// Виды отметок времени на скриншотах. time.Parse ставит год 0 и 1 января, если их нет в отметке,
+// поэтому отметки разных видов нельзя сравнивать между собой.
+const (
+	screenshotTimeOnly     = iota // только время, например 15:04
+	screenshotTimeNoYear          // дата без года, например Jan 2, 15:04
+	screenshotTimeWithDate        // полная дата
+)
+
+func screenshotTimeKind(t time.Time) int {
+	switch {
+	case t.Year() != 0:
+		return screenshotTimeWithDate
+	case t.Month() == time.January && t.Day() == 1:
+		return screenshotTimeOnly
+	default:
+		return screenshotTimeNoYear
+	}
+}
+
+func parseScreenshotTime(s string) (time.Time, bool) {
+	s = screenshotTimePattern.ReplaceAllString(strings.ToUpper(strings.TrimSpace(s)), " ")
+	s = strings.NewReplacer("A.M.", "AM", "P.M.", "PM").Replace(s)
+	for _, layout := range screenshotTimeLayouts {
+		if t, err := time.Parse(strings.ToUpper(layout), s); err == nil {
+			return t, true
+		}
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// responseTimeStats считает статистику по репликам в порядке появления. Время без даты считается
+// идущим подряд: если оно уменьшилось, значит наступил следующий день. Задержка между отметками
+// разных видов (только время и полная дата) не считается.
+func responseTimeStats(lines []ScreenshotLine) map[string]interface{} {
+	stats := make(map[string]*speakerStats)
+	delays := make(map[string][]float64)
+
+	var prevSpeaker string
+	var prevTime time.Time
+	var prevKind int
+	var dayOffset time.Duration
+	var lastRaw time.Time
+	parsed := 0
+	for _, line := range lines {
+		speaker := strings.TrimSpace(line.Speaker)
+		if speaker == "" {
+			continue
+		}
+		if stats[speaker] == nil {
+			stats[speaker] = &speakerStats{}
+		}
+		stats[speaker].Messages++
+
+		t, ok := parseScreenshotTime(line.Timestamp)
+		if !ok {
+			continue
+		}
+		parsed++
+		kind := screenshotTimeKind(t)
+		if kind == screenshotTimeOnly {
+			if !lastRaw.IsZero() && t.Before(lastRaw) {
+				dayOffset += 24 * time.Hour
+			}
+			lastRaw = t
+			t = t.Add(dayOffset)
+		}
+
+		if prevSpeaker != "" && speaker != prevSpeaker && !prevTime.IsZero() && kind == prevKind && !t.Before(prevTime) {
+			delays[speaker] = append(delays[speaker], t.Sub(prevTime).Minutes())
+		}
+		prevSpeaker = speaker
+		prevTime = t
+		prevKind = kind
+	}
+
+	for speaker, d := range delays {
+		s := stats[speaker]
+		s.Replies = len(d)
+		sort.Float64s(d)
+		var sum float64
+		for _, v := range d {
+			sum += v
+		}
+		s.AvgReplyMinutes = roundMinutes(sum / float64(len(d)))
+		s.MedianReplyMinutes = roundMinutes(d[len(d)/2])
+		if len(d)%2 == 0 {
+			s.MedianReplyMinutes = roundMinutes((d[len(d)/2-1] + d[len(d)/2]) / 2)
+		}
+		s.MaxReplyMinutes = roundMinutes(d[len(d)-1])
+	}
+
+	return map[string]interface{}{
+		"lines":             len(lines),
+		"lines_with_time":   parsed,
+		"speakers":          stats,
+		"screenshots_found": len(lines) > 0,
+	}
+}
+
+func roundMinutes(m float64) float64 {
+	return float64(int(m*10+0.5)) / 10
+}
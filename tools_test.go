@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScreenshotTime(t *testing.T) {
+	tests := []struct {
+		in       string
+		want     time.Time
+		wantKind int
+		ok       bool
+	}{
+		{"15:04", time.Date(0, 1, 1, 15, 4, 0, 0, time.UTC), screenshotTimeOnly, true},
+		{" 9:05 ", time.Date(0, 1, 1, 9, 5, 0, 0, time.UTC), screenshotTimeOnly, true},
+		{"23:59:30", time.Date(0, 1, 1, 23, 59, 30, 0, time.UTC), screenshotTimeOnly, true},
+		{"3:04 pm", time.Date(0, 1, 1, 15, 4, 0, 0, time.UTC), screenshotTimeOnly, true},
+		{"3:04  p.m.", time.Date(0, 1, 1, 15, 4, 0, 0, time.UTC), screenshotTimeOnly, true},
+		{"12:00 AM", time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC), screenshotTimeOnly, true},
+		{"2024-03-05 10:20", time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC), screenshotTimeWithDate, true},
+		{"05.03.2024, 10:20", time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC), screenshotTimeWithDate, true},
+		{"3/5/24, 1:20 PM", time.Date(2024, 3, 5, 13, 20, 0, 0, time.UTC), screenshotTimeWithDate, true},
+		{"Mar 5, 10:20", time.Date(0, 3, 5, 10, 20, 0, 0, time.UTC), screenshotTimeNoYear, true},
+		{"5 Mar 10:20", time.Date(0, 3, 5, 10, 20, 0, 0, time.UTC), screenshotTimeNoYear, true},
+		{"", time.Time{}, 0, false},
+		{"yesterday", time.Time{}, 0, false},
+		{"25:00", time.Time{}, 0, false},
+		{"10:61", time.Time{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseScreenshotTime(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("parseScreenshotTime(%q) ok = %v, want %v", tt.in, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseScreenshotTime(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+			if kind := screenshotTimeKind(got); kind != tt.wantKind {
+				t.Errorf("screenshotTimeKind(%q) = %d, want %d", tt.in, kind, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestResponseTimeStats(t *testing.T) {
+	line := func(speaker, ts string) ScreenshotLine {
+		return ScreenshotLine{Speaker: speaker, Message: "...", Timestamp: ts}
+	}
+	tests := []struct {
+		name         string
+		lines        []ScreenshotLine
+		wantWithTime int
+		wantReplies  map[string]int
+		wantAvg      map[string]float64
+		wantMedian   map[string]float64
+		wantMax      map[string]float64
+	}{
+		{
+			name:        "empty",
+			wantReplies: map[string]int{},
+		},
+		{
+			name: "alternating speakers",
+			lines: []ScreenshotLine{
+				line("Me", "10:00"), line("Him", "10:05"), line("Me", "10:06"), line("Him", "10:30"),
+			},
+			wantWithTime: 4,
+			wantReplies:  map[string]int{"Me": 1, "Him": 2},
+			wantAvg:      map[string]float64{"Me": 1, "Him": 14.5},
+			wantMedian:   map[string]float64{"Me": 1, "Him": 14.5},
+			wantMax:      map[string]float64{"Me": 1, "Him": 24},
+		},
+		{
+			name: "same speaker twice is not a reply",
+			lines: []ScreenshotLine{
+				line("Me", "10:00"), line("Me", "10:01"), line("Him", "10:11"),
+			},
+			wantWithTime: 3,
+			wantReplies:  map[string]int{"Him": 1},
+			wantAvg:      map[string]float64{"Him": 10},
+			wantMedian:   map[string]float64{"Him": 10},
+			wantMax:      map[string]float64{"Him": 10},
+		},
+		{
+			name:         "time-only stamps roll over midnight",
+			lines:        []ScreenshotLine{line("Me", "23:50"), line("Him", "00:10")},
+			wantWithTime: 2,
+			wantReplies:  map[string]int{"Him": 1},
+			wantAvg:      map[string]float64{"Him": 20},
+			wantMedian:   map[string]float64{"Him": 20},
+			wantMax:      map[string]float64{"Him": 20},
+		},
+		{
+			name: "time-only and dated stamps are not compared",
+			lines: []ScreenshotLine{
+				line("Me", "10:00"), line("Him", "2024-03-05 10:05"), line("Me", "10:07"),
+			},
+			wantWithTime: 3,
+			wantReplies:  map[string]int{},
+		},
+		{
+			name: "missing and unparsable stamps",
+			lines: []ScreenshotLine{
+				line("Me", ""), line("Him", "вчера"), line("", "10:00"), line("Me", "10:00"), line("Him", "10:03"),
+			},
+			wantWithTime: 2, // реплики без говорящего не учитываются
+			wantReplies:  map[string]int{"Him": 1},
+			wantAvg:      map[string]float64{"Him": 3},
+			wantMedian:   map[string]float64{"Him": 3},
+			wantMax:      map[string]float64{"Him": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := responseTimeStats(tt.lines)
+			if got["lines_with_time"] != tt.wantWithTime {
+				t.Errorf("lines_with_time = %v, want %d", got["lines_with_time"], tt.wantWithTime)
+			}
+			speakers := got["speakers"].(map[string]*speakerStats)
+			for name, s := range speakers {
+				if s.Replies != tt.wantReplies[name] {
+					t.Errorf("%s replies = %d, want %d", name, s.Replies, tt.wantReplies[name])
+				}
+				if s.AvgReplyMinutes != tt.wantAvg[name] || s.MedianReplyMinutes != tt.wantMedian[name] || s.MaxReplyMinutes != tt.wantMax[name] {
+					t.Errorf("%s avg/median/max = %v/%v/%v, want %v/%v/%v", name,
+						s.AvgReplyMinutes, s.MedianReplyMinutes, s.MaxReplyMinutes,
+						tt.wantAvg[name], tt.wantMedian[name], tt.wantMax[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	transcriptionJobWorkers        = 2
+	transcriptionJobQueueSize      = 100
+	transcriptionJobStaleAfter     = 10 * time.Minute
+	transcriptionJobSweepEvery     = time.Minute
+	transcriptionStreamPollEvery   = time.Second
+	transcriptionStreamMaxDuration = 2 * time.Minute
+	transcriptionJobMaxActive      = 5  // незавершённых задач на пользователя
+	transcriptionJobMaxPerHour     = 60 // задач на пользователя за последний час
+)
+
+var transcriptionJobQueue = make(chan string, transcriptionJobQueueSize)
+
+// errTranscriptionsFailed — ни одна из задач транскрипции хода не завершилась успешно.
+var errTranscriptionsFailed = errors.New("не удалось транскрибировать ни одного голосового сообщения")
+
+// transcriptionsHandler: POST создаёт задачу транскрипции, GET возвращает её статус
+// (или держит SSE-соединение до готовности при Accept: text/event-stream).
+func transcriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleTranscriptionGet(w, r)
+	case http.MethodPost:
+		handleTranscriptionPost(w, r)
+	default:
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+	}
+}
+
+func handleTranscriptionPost(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	var req struct {
+		VoicePath string `json:"voice_path"`
+		Language  string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "json_decode_error", "Неверный формат JSON", nil, err)
+		return
+	}
+	if req.VoicePath == "" {
+		writeError(w, "missing_voice_path", "Параметр voice_path обязателен", nil, nil)
+		return
+	}
+	// Голосовые загружаются в папку пользователя; чужой файл транскрибировать нельзя
+	if !ownsStoragePath(userID, req.VoicePath) {
+		writeError(w, "invalid_voice_path", "Голосовое сообщение не принадлежит пользователю", nil, nil)
+		return
+	}
+	if _, err := getVoiceSignedURL(req.VoicePath); err != nil {
+		writeError(w, "not_found", "Голосовое сообщение не найдено", nil, err)
+		return
+	}
+
+	job, created, err := insertTranscriptionJob(userID, req.VoicePath, normalizeLanguageHint(req.Language))
+	if err != nil {
+		writeError(w, "db_error", "Ошибка создания задачи транскрипции", nil, err)
+		return
+	}
+	if !created {
+		writeError(w, "transcription_limit_reached", "Слишком много задач транскрипции, попробуйте позже", nil, nil)
+		return
+	}
+
+	enqueueTranscriptionJob(job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// ownsStoragePath проверяет, что объект лежит в папке пользователя: клиент загружает файлы по пути userID/...
+func ownsStoragePath(userID, path string) bool {
+	path = strings.TrimPrefix(path, "/")
+	return strings.HasPrefix(path, userID+"/") && !strings.Contains(path, "..")
+}
+
+// insertTranscriptionJob создаёт задачу, если у пользователя не превышены лимиты незавершённых
+// задач и задач за час. Возвращает false, если задача не создана. Как и в insertMemory, вставки
+// одного пользователя идут по очереди под блокировкой строки users.
+func insertTranscriptionJob(userID, voicePath, language string) (TranscriptionJob, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TranscriptionJob{}, false, fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return TranscriptionJob{}, false, fmt.Errorf("ошибка блокировки задач пользователя: %v", err)
+	}
+
+	var job TranscriptionJob
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO transcription_jobs (user_id, voice_path, language, status)
+		SELECT $1, $2, $3, 'pending'
+		WHERE (SELECT count(*) FROM transcription_jobs
+		       WHERE user_id = $1 AND status IN ('pending', 'processing')) < $4
+		  AND (SELECT count(*) FROM transcription_jobs
+		       WHERE user_id = $1 AND created_at > now() - interval '1 hour') < $5
+		RETURNING id, status, voice_path, created_at
+	`, userID, voicePath, language, transcriptionJobMaxActive, transcriptionJobMaxPerHour).Scan(&job.ID, &job.Status, &job.VoicePath, &createdAt)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	} else if err != nil {
+		return job, false, fmt.Errorf("ошибка создания задачи транскрипции: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return job, false, fmt.Errorf("ошибка создания задачи транскрипции: %v", err)
+	}
+	job.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+	job.UpdatedAt = job.CreatedAt
+	return job, true, nil
+}
+
+func handleTranscriptionGet(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "unauthorized", err.Error(), nil, err)
+		return
+	}
+
+	jobID := r.URL.Query().Get("id")
+	if jobID == "" {
+		writeError(w, "missing_id", "Параметр id обязателен", nil, nil)
+		return
+	}
+
+	if r.Header.Get("Accept") == "text/event-stream" {
+		streamTranscriptionJob(w, r, userID, jobID)
+		return
+	}
+
+	jobs, err := getTranscriptionJobs(userID, []string{jobID})
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения задачи транскрипции", nil, err)
+		return
+	}
+	if len(jobs) == 0 {
+		writeError(w, "not_found", "Задача транскрипции не найдена", nil, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs[0])
+}
+
+// streamTranscriptionJob отправляет SSE-событие status при каждом изменении статуса задачи
+// и закрывает поток, когда задача завершена.
+func streamTranscriptionJob(w http.ResponseWriter, r *http.Request, userID, jobID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "streaming_unsupported", "Сервер не поддерживает SSE", nil, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(transcriptionStreamPollEvery)
+	defer ticker.Stop()
+	timeout := time.After(transcriptionStreamMaxDuration)
+
+	var lastStatus string
+	for {
+		jobs, err := getTranscriptionJobs(userID, []string{jobID})
+		if err != nil || len(jobs) == 0 {
+			if err != nil {
+				log.Printf("Ошибка получения задачи транскрипции %s: %v", jobID, err)
+			}
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", `{"error_type":"not_found"}`)
+			flusher.Flush()
+			return
+		}
+
+		job := jobs[0]
+		if job.Status != lastStatus {
+			data, _ := json.Marshal(job)
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			lastStatus = job.Status
+		}
+		if job.Status == "done" || job.Status == "failed" {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getTranscriptionJobs возвращает задачи пользователя в порядке jobIDs; чужие, несуществующие
+// и id не в формате UUID пропускаются.
+func getTranscriptionJobs(userID string, jobIDs []string) ([]TranscriptionJob, error) {
+	validIDs := make([]string, 0, len(jobIDs))
+	for _, id := range jobIDs {
+		if _, err := uuid.Parse(id); err == nil {
+			validIDs = append(validIDs, id)
+		}
+	}
+	if len(validIDs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, status, voice_path, result, error, created_at, updated_at
+		FROM transcription_jobs
+		WHERE user_id = $1 AND id = ANY($2)
+	`, userID, pq.Array(validIDs))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запроса задач транскрипции: %v", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[string]TranscriptionJob)
+	for rows.Next() {
+		var job TranscriptionJob
+		var result, jobError sql.NullString
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&job.ID, &job.Status, &job.VoicePath, &result, &jobError, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования задачи транскрипции: %v", err)
+		}
+		if result.Valid {
+			job.Result = &VoiceTranscription{}
+			if err := json.Unmarshal([]byte(result.String), job.Result); err != nil {
+				return nil, fmt.Errorf("ошибка разбора результата транскрипции: %v", err)
+			}
+		}
+		job.Error = jobError.String
+		job.CreatedAt = createdAt.Format("2006-01-02T15:04:05Z")
+		job.UpdatedAt = updatedAt.Format("2006-01-02T15:04:05Z")
+		byID[job.ID] = job
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+
+	var jobs []TranscriptionJob
+	for _, id := range jobIDs {
+		if job, ok := byID[id]; ok {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// finishedTranscriptions проверяет, что все задачи найдены и завершены, и возвращает их результаты.
+// Если хотя бы одна задача ещё выполняется, возвращает ошибку и текущие статусы задач;
+// если все задачи завершились ошибкой — errTranscriptionsFailed.
+func finishedTranscriptions(userID string, jobIDs []string) ([]VoiceTranscription, []TranscriptionJob, error) {
+	jobs, err := getTranscriptionJobs(userID, jobIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(jobs) != len(jobIDs) {
+		return nil, jobs, fmt.Errorf("задача транскрипции не найдена")
+	}
+
+	var results []VoiceTranscription
+	succeeded := false
+	for _, job := range jobs {
+		switch job.Status {
+		case "done":
+			result := *job.Result
+			result.Path = job.VoicePath
+			results = append(results, result)
+			succeeded = true
+		case "failed":
+			results = append(results, VoiceTranscription{Path: job.VoicePath, Status: "failed", Error: job.Error})
+		default:
+			return nil, jobs, fmt.Errorf("транскрипция %s ещё не готова", job.ID)
+		}
+	}
+	// Как и при синхронной транскрипции, ход без единой расшифровки не отправляется
+	if !succeeded {
+		return results, jobs, errTranscriptionsFailed
+	}
+	return results, jobs, nil
+}
+
+// startTranscriptionWorkers запускает обработчики очереди и возвращает в неё задачи,
+// не завершённые до перезапуска сервера.
+func startTranscriptionWorkers() {
+	for i := 0; i < transcriptionJobWorkers; i++ {
+		go func() {
+			for jobID := range transcriptionJobQueue {
+				processTranscriptionJob(jobID)
+			}
+		}()
+	}
+
+	// Задачи, застрявшие в processing после быстрого перезапуска, станут «старыми» уже после старта,
+	// поэтому проверка повторяется периодически
+	go func() {
+		ticker := time.NewTicker(transcriptionJobSweepEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			requeueStaleTranscriptionJobs()
+		}
+	}()
+	requeueStaleTranscriptionJobs()
+
+	rows, err := db.Query(`SELECT id FROM transcription_jobs WHERE status = 'pending' ORDER BY created_at ASC`)
+	if err != nil {
+		log.Printf("Ошибка загрузки задач транскрипции: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var jobIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Ошибка чтения задачи транскрипции: %v", err)
+			return
+		}
+		jobIDs = append(jobIDs, id)
+	}
+	for _, id := range jobIDs {
+		enqueueTranscriptionJob(id)
+	}
+	if len(jobIDs) > 0 {
+		log.Printf("Возобновлено задач транскрипции: %d", len(jobIDs))
+	}
+}
+
+// requeueStaleTranscriptionJobs возвращает в очередь задачи, застрявшие в processing дольше
+// transcriptionJobStaleAfter (экземпляр сервера упал или перезапустился во время обработки).
+func requeueStaleTranscriptionJobs() {
+	rows, err := db.Query(`
+		UPDATE transcription_jobs
+		SET status = 'pending', updated_at = now()
+		WHERE status = 'processing' AND updated_at < $1
+		RETURNING id
+	`, time.Now().Add(-transcriptionJobStaleAfter))
+	if err != nil {
+		log.Printf("Ошибка восстановления задач транскрипции: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var jobIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Ошибка чтения задачи транскрипции: %v", err)
+			return
+		}
+		jobIDs = append(jobIDs, id)
+	}
+	for _, id := range jobIDs {
+		enqueueTranscriptionJob(id)
+	}
+	if len(jobIDs) > 0 {
+		log.Printf("Возвращено в очередь зависших задач транскрипции: %d", len(jobIDs))
+	}
+}
+
+// enqueueTranscriptionJob ставит задачу в очередь, не блокируя вызывающего, если очередь заполнена.
+func enqueueTranscriptionJob(jobID string) {
+	select {
+	case transcriptionJobQueue <- jobID:
+	default:
+		go func() { transcriptionJobQueue <- jobID }()
+	}
+}
+
+// processTranscriptionJob захватывает задачу и выполняет транскрипцию.
+// Условие status = 'pending' не даёт двум экземплярам сервера обработать одну задачу.
+func processTranscriptionJob(jobID string) {
+	var userID, voicePath, language string
+	err := db.QueryRow(`
+		UPDATE transcription_jobs
+		SET status = 'processing', updated_at = now()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING user_id, voice_path, language
+	`, jobID).Scan(&userID, &voicePath, &language)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Printf("Ошибка захвата задачи транскрипции %s: %v", jobID, err)
+		return
+	}
+
+	result, err := transcribeVoiceWithRetry(voicePath, language, 0)
+	if err != nil {
+		log.Printf("Ошибка транскрипции по задаче %s: %v", jobID, err)
+		_, err = db.Exec(`
+			UPDATE transcription_jobs
+			SET status = 'failed', error = $2, updated_at = now()
+			WHERE id = $1
+		`, jobID, err.Error())
+		if err != nil {
+			log.Printf("Ошибка сохранения статуса задачи транскрипции %s: %v", jobID, err)
+		}
+		return
+	}
+
+	result.Path = voicePath
+	result.Status = "ok"
+
+	// Расход учитывается здесь, а не в сообщении, к которому потом приложат результат
+	var usage usageStats
+	usage.addTranscriptions([]VoiceTranscription{result})
+	recordUsage(userID, usage)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Ошибка кодирования результата транскрипции %s: %v", jobID, err)
+		return
+	}
+	_, err = db.Exec(`
+		UPDATE transcription_jobs
+		SET status = 'done', result = $2, updated_at = now()
+		WHERE id = $1
+	`, jobID, string(data))
+	if err != nil {
+		log.Printf("Ошибка сохранения результата транскрипции %s: %v", jobID, err)
+	}
+}
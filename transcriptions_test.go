@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestOwnsStoragePath(t *testing.T) {
+	const userID = "0b6f8a3e-4c1d-4f3a-9a7e-2d5c8b1e6f90"
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"own file", userID + "/voice.m4a", true},
+		{"leading slash", "/" + userID + "/voice.m4a", true},
+		{"other user", "1c7a9b4f-5d2e-4a4b-8b8f-3e6d9c2f7a01/voice.m4a", false},
+		{"user id as name prefix", userID + "x/voice.m4a", false},
+		{"no folder", "voice.m4a", false},
+		{"path traversal", userID + "/../other/voice.m4a", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ownsStoragePath(userID, tt.path); got != tt.want {
+				t.Errorf("ownsStoragePath(%q) = %v; want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
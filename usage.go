@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	usageDefaultDays  = 30
+	usageDefaultLimit = 100
+	usageMaxLimit     = 1000
+
+	// OpenAI не сообщает, сколько токенов ушло на картинки, поэтому они оцениваются по detail:
+	// low — фиксированные 85 токенов, high/auto — как у типичного скриншота (85 + 4 тайла по 170).
+	imageTokensLow  = 85
+	imageTokensHigh = 765
+
+	whisperPricePerMinute = 0.006
+)
+
+// modelPrice — цена модели в долларах за миллион токенов.
+type modelPrice struct {
+	Input       float64
+	CachedInput float64
+	Output      float64
+}
+
+// modelPrices — прайс-лист OpenAI. Датированные версии (gpt-4o-2024-08-06) ищутся по префиксу.
+var modelPrices = map[string]modelPrice{
+	"gpt-4o":       {Input: 2.50, CachedInput: 1.25, Output: 10.00},
+	"gpt-4o-mini":  {Input: 0.15, CachedInput: 0.075, Output: 0.60},
+	"gpt-4.1":      {Input: 2.00, CachedInput: 0.50, Output: 8.00},
+	"gpt-4.1-mini": {Input: 0.40, CachedInput: 0.10, Output: 1.60},
+	"gpt-4.1-nano": {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+}
+
+// priceForModel возвращает цену модели; из нескольких подходящих префиксов берётся самый длинный.
+func priceForModel(model string) (modelPrice, bool) {
+	if p, ok := modelPrices[model]; ok {
+		return p, true
+	}
+	var best string
+	for name := range modelPrices {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return modelPrice{}, false
+	}
+	return modelPrices[best], true
+}
+
+// usageStats — потреблённые токены, секунды аудио и стоимость запросов к OpenAI.
+type usageStats struct {
+	Requests         int
+	PromptTokens     int // включая кэшированные и токены картинок
+	CachedTokens     int
+	CompletionTokens int
+	ImageTokens      int // оценка, см. imageTokensHigh
+	AudioSeconds     float64
+	CostUSD          float64
+}
+
+// addCompletion учитывает ответ Chat Completions, полученный от модели model на запрос req.
+func (u *usageStats) addCompletion(model string, req VisionRequest, resp *OpenAIResponse) {
+	u.Requests++
+	for _, m := range req.Messages {
+		for _, item := range m.Content {
+			if item.Type != "image_url" || item.ImageURL == nil {
+				continue
+			}
+			if item.ImageURL.Detail == "low" {
+				u.ImageTokens += imageTokensLow
+			} else {
+				u.ImageTokens += imageTokensHigh
+			}
+		}
+	}
+	if resp.Usage == nil {
+		return
+	}
+
+	prompt := resp.Usage.PromptTokens
+	cached := resp.Usage.PromptTokensDetails.CachedTokens
+	completion := resp.Usage.CompletionTokens
+	u.PromptTokens += prompt
+	u.CachedTokens += cached
+	u.CompletionTokens += completion
+
+	price, ok := priceForModel(model)
+	if !ok {
+		log.Printf("Нет цены для модели %s, стоимость запроса не учтена", model)
+		return
+	}
+	u.CostUSD += (float64(prompt-cached)*price.Input + float64(cached)*price.CachedInput + float64(completion)*price.Output) / 1e6
+}
+
+// addTranscriptions учитывает успешные транскрипции Whisper: OpenAI берёт плату за каждую секунду аудио.
+func (u *usageStats) addTranscriptions(results []VoiceTranscription) {
+	for _, res := range results {
+		if res.Status != "ok" {
+			continue
+		}
+		u.Requests++
+		u.AudioSeconds += res.Duration
+		u.CostUSD += res.Duration / 60 * whisperPricePerMinute
+	}
+}
+
+func (u *usageStats) merge(o usageStats) {
+	u.Requests += o.Requests
+	u.PromptTokens += o.PromptTokens
+	u.CachedTokens += o.CachedTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.ImageTokens += o.ImageTokens
+	u.AudioSeconds += o.AudioSeconds
+	u.CostUSD += o.CostUSD
+}
+
+// recordUsage добавляет расход к дневной статистике пользователя (по UTC). Ошибки только логируются:
+// учёт не должен ломать ответ пользователю.
+func recordUsage(userID string, u usageStats) {
+	if u.Requests == 0 {
+		return
+	}
+	_, err := db.Exec(`
+		INSERT INTO usage_daily (user_id, day, requests, prompt_tokens, cached_tokens, completion_tokens, image_tokens, audio_seconds, cost_usd)
+		VALUES ($1, (now() AT TIME ZONE 'UTC')::date, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, day) DO UPDATE
+		SET requests = usage_daily.requests + EXCLUDED.requests,
+		    prompt_tokens = usage_daily.prompt_tokens + EXCLUDED.prompt_tokens,
+		    cached_tokens = usage_daily.cached_tokens + EXCLUDED.cached_tokens,
+		    completion_tokens = usage_daily.completion_tokens + EXCLUDED.completion_tokens,
+		    image_tokens = usage_daily.image_tokens + EXCLUDED.image_tokens,
+		    audio_seconds = usage_daily.audio_seconds + EXCLUDED.audio_seconds,
+		    cost_usd = usage_daily.cost_usd + EXCLUDED.cost_usd
+	`, userID, u.Requests, u.PromptTokens, u.CachedTokens, u.CompletionTokens, u.ImageTokens, u.AudioSeconds, u.CostUSD)
+	if err != nil {
+		log.Printf("Ошибка учёта расхода пользователя %s: %v", userID, err)
+	}
+}
+
+// recordMessageUsage сохраняет расход на запросы, из которых получено сообщение, и добавляет его
+// к дневной статистике пользователя.
+func recordMessageUsage(messageID, userID string, u usageStats) {
+	if u.Requests == 0 {
+		return
+	}
+	_, err := db.Exec(`
+		UPDATE messages
+		SET prompt_tokens = $2, completion_tokens = $3, image_tokens = $4, audio_seconds = $5, cost_usd = $6
+		WHERE id = $1
+	`, messageID, u.PromptTokens, u.CompletionTokens, u.ImageTokens, u.AudioSeconds, u.CostUSD)
+	if err != nil {
+		log.Printf("Ошибка сохранения расхода сообщения %s: %v", messageID, err)
+	}
+	recordUsage(userID, u)
+}
+
+// adminUsageHandler (GET /api/admin/usage) возвращает расход на OpenAI, самые дорогие первыми.
+// group=day (по умолчанию) — по пользователям и дням, group=user — итоги по пользователям
+// с пакетами, купленными за тот же период, по ним видна маржа. Фильтры: from, to (YYYY-MM-DD, по умолчанию
+// последние 30 дней), user_id, limit.
+func adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "method_not_allowed", "Метод не поддерживается", nil, nil)
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -usageDefaultDays+1)
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				writeError(w, "invalid_"+p.name, "Параметр "+p.name+" должен быть в формате YYYY-MM-DD", nil, err)
+				return
+			}
+			*p.dst = t
+		}
+	}
+	limit := usageDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, "invalid_limit", "Параметр limit должен быть положительным числом", nil, err)
+			return
+		}
+		limit = min(n, usageMaxLimit)
+	}
+
+	var items []UsageSummary
+	var err error
+	switch query.Get("group") {
+	case "", "day":
+		items, err = usageByDay(from, to, query.Get("user_id"), limit)
+	case "user":
+		items, err = usageByUser(from, to, query.Get("user_id"), limit)
+	default:
+		writeError(w, "invalid_group", "Параметр group должен быть day или user", nil, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, "db_error", "Ошибка получения расхода", nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func usageByDay(from, to time.Time, userID string, limit int) ([]UsageSummary, error) {
+	rows, err := db.Query(`
+		SELECT user_id, day, requests, prompt_tokens, cached_tokens, completion_tokens, image_tokens, audio_seconds, cost_usd
+		FROM usage_daily
+		WHERE day BETWEEN $1::date AND $2::date
+		  AND ($3 = '' OR user_id::text = $3)
+		ORDER BY cost_usd DESC, day DESC, user_id
+		LIMIT $4
+	`, from, to, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения расхода по дням: %v", err)
+	}
+	defer rows.Close()
+
+	items := []UsageSummary{}
+	for rows.Next() {
+		var s UsageSummary
+		var day time.Time
+		if err := rows.Scan(&s.UserID, &day, &s.Requests, &s.PromptTokens, &s.CachedTokens, &s.CompletionTokens,
+			&s.ImageTokens, &s.AudioSeconds, &s.CostUSD); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования расхода: %v", err)
+		}
+		s.Day = day.Format("2006-01-02")
+		s.CostUSD = roundCost(s.CostUSD)
+		items = append(items, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return items, nil
+}
+
+func usageByUser(from, to time.Time, userID string, limit int) ([]UsageSummary, error) {
+	rows, err := db.Query(`
+		SELECT d.user_id, sum(d.requests), sum(d.prompt_tokens), sum(d.cached_tokens), sum(d.completion_tokens),
+		       sum(d.image_tokens), sum(d.audio_seconds), sum(d.cost_usd),
+		       COALESCE((SELECT array_agg(t.product_id ORDER BY t.created_at) FROM processed_transactions t
+		                 WHERE t.user_id = d.user_id
+		                   AND t.created_at >= $1::date AND t.created_at < $2::date + 1), '{}')
+		FROM usage_daily d
+		WHERE d.day BETWEEN $1::date AND $2::date
+		  AND ($3 = '' OR d.user_id::text = $3)
+		GROUP BY d.user_id
+		ORDER BY sum(d.cost_usd) DESC, d.user_id
+		LIMIT $4
+	`, from, to, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения расхода по пользователям: %v", err)
+	}
+	defer rows.Close()
+
+	items := []UsageSummary{}
+	for rows.Next() {
+		var s UsageSummary
+		var products []string
+		if err := rows.Scan(&s.UserID, &s.Requests, &s.PromptTokens, &s.CachedTokens, &s.CompletionTokens,
+			&s.ImageTokens, &s.AudioSeconds, &s.CostUSD, pq.Array(&products)); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования расхода: %v", err)
+		}
+		s.Purchases = products
+		for _, p := range products {
+			s.PurchasedMessages += packMessages[p]
+		}
+		s.CostUSD = roundCost(s.CostUSD)
+		items = append(items, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка обхода строк: %v", err)
+	}
+	return items, nil
+}
+
+func roundCost(c float64) float64 {
+	return math.Round(c*1e6) / 1e6
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPriceForModel(t *testing.T) {
+	tests := []struct {
+		model     string
+		wantInput float64
+		ok        bool
+	}{
+		{"gpt-4o", 2.50, true},
+		{"gpt-4o-mini", 0.15, true},
+		{"gpt-4o-2024-08-06", 2.50, true},
+		{"gpt-4o-mini-2024-07-18", 0.15, true}, // самый длинный префикс, а не gpt-4o
+		{"gpt-4.1-nano-2025-04-14", 0.10, true},
+		{"gpt-4", 0, false},
+		{"gpt-4omni", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			p, ok := priceForModel(tt.model)
+			if ok != tt.ok || p.Input != tt.wantInput {
+				t.Errorf("priceForModel(%q) = %v, %v; want input %v, %v", tt.model, p, ok, tt.wantInput, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUsageStatsAddCompletion(t *testing.T) {
+	withImages := VisionRequest{Messages: []VisionMessage{{Role: "user", Content: []VisionContentItem{
+		{Type: "text", Text: "hi"},
+		{Type: "image_url", ImageURL: &VisionImageURL{URL: "a", Detail: "low"}},
+		{Type: "image_url", ImageURL: &VisionImageURL{URL: "b", Detail: "high"}},
+		{Type: "image_url"}, // без ссылки не считается
+	}}}}
+	usage := func(prompt, cached, completion int) *OpenAIUsage {
+		u := &OpenAIUsage{PromptTokens: prompt, CompletionTokens: completion}
+		u.PromptTokensDetails.CachedTokens = cached
+		return u
+	}
+	tests := []struct {
+		name        string
+		model       string
+		req         VisionRequest
+		resp        OpenAIResponse
+		wantImages  int
+		wantPrompt  int
+		wantCompl   int
+		wantCostUSD float64
+	}{
+		{"no usage in response", "gpt-4o", withImages, OpenAIResponse{}, imageTokensLow + imageTokensHigh, 0, 0, 0},
+		{"uncached", "gpt-4o", VisionRequest{}, OpenAIResponse{Usage: usage(1_000_000, 0, 0)}, 0, 1_000_000, 0, 2.50},
+		{"cached and output", "gpt-4o-mini", VisionRequest{}, OpenAIResponse{Usage: usage(2_000_000, 1_000_000, 1_000_000)}, 0, 2_000_000, 1_000_000, 0.15 + 0.075 + 0.60},
+		{"unknown model is not priced", "o1-preview", VisionRequest{}, OpenAIResponse{Usage: usage(1000, 0, 1000)}, 0, 1000, 1000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u usageStats
+			resp := tt.resp
+			u.addCompletion(tt.model, tt.req, &resp)
+			if u.Requests != 1 || u.ImageTokens != tt.wantImages || u.PromptTokens != tt.wantPrompt || u.CompletionTokens != tt.wantCompl {
+				t.Errorf("usage = %+v", u)
+			}
+			if math.Abs(u.CostUSD-tt.wantCostUSD) > 1e-9 {
+				t.Errorf("cost = %v, want %v", u.CostUSD, tt.wantCostUSD)
+			}
+		})
+	}
+}
+
+func TestUsageStatsAddTranscriptions(t *testing.T) {
+	var u usageStats
+	u.addTranscriptions([]VoiceTranscription{
+		{Status: "ok", Duration: 90},
+		{Status: "failed", Duration: 30},
+		{Status: "ok", Duration: 30},
+	})
+	if u.Requests != 2 || u.AudioSeconds != 120 {
+		t.Errorf("usage = %+v, want 2 requests and 120 s", u)
+	}
+	if want := 2 * whisperPricePerMinute; math.Abs(u.CostUSD-want) > 1e-12 {
+		t.Errorf("cost = %v, want %v", u.CostUSD, want)
+	}
+
+	var total usageStats
+	total.merge(u)
+	total.merge(u)
+	if total.Requests != 4 || total.AudioSeconds != 240 {
+		t.Errorf("merge = %+v", total)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	verdictRepairAttempts = 2
+	verdictMaxFlags       = 20
+)
+
+const verdictPrompt = `Answer the user as usual, and also score the conversation for red flags.
+Return ONLY a JSON object of the form:
+{"reply": "...", "verdict": {"risk_score": 0, "summary": "...", "flags": [{"category": "...", "severity": "...", "evidence": "...", "explanation": "..."}]}}
+- "reply": your full answer to the user, in the user's language;
+- "risk_score": an integer from 0 (no concerns) to 100 (severe, immediate concern);
+- "summary": one or two sentences explaining the score;
+- "category": one of manipulation, gaslighting, love_bombing, controlling, disrespect, dishonesty, inconsistency, pressure, aggression, other;
+- "severity": one of low, medium, high;
+- "evidence": an exact quote from the conversation that shows the flag;
+- "explanation": why the quote is a red flag.
+If there are no red flags, return an empty "flags" array.`
+
+var verdictCategories = map[string]bool{
+	"manipulation":  true,
+	"gaslighting":   true,
+	"love_bombing":  true,
+	"controlling":   true,
+	"disrespect":    true,
+	"dishonesty":    true,
+	"inconsistency": true,
+	"pressure":      true,
+	"aggression":    true,
+	"other":         true,
+}
+
+var verdictSeverities = map[string]bool{"low": true, "medium": true, "high": true}
+
+// structuredReply — ответ модели в структурированном режиме.
+type structuredReply struct {
+	Reply   string   `json:"reply"`
+	Verdict *Verdict `json:"verdict"`
+}
+
+// requestStructuredReply просит модель вернуть ответ вместе с оценкой рисков в JSON и проверяет его.
+// Если ответ не проходит проверку, модель получает свой ответ и список ошибок и исправляет его
+// (до verdictRepairAttempts раз). Если исправить не удалось, возвращается обычный текстовый ответ без оценки.
+func requestStructuredReply(persona Persona, visionContents []VisionContentItem, meta *replyMeta) (string, *Verdict, error) {
+	contents := append(append([]VisionContentItem(nil), visionContents...), VisionContentItem{Type: "text", Text: verdictPrompt})
+	messages := []VisionMessage{{Role: "user", Content: contents}}
+	conversation := conversationText(visionContents)
+	usageBefore := meta.Usage
+
+	for attempt := 0; attempt <= verdictRepairAttempts; attempt++ {
+		openaiResp, err := requestPersonaCompletion(persona, VisionRequest{
+			Messages:       messages,
+			ResponseFormat: &ResponseFormat{Type: "json_object"},
+		}, meta)
+		if err != nil {
+			return "", nil, err
+		}
+		raw := openaiResp.Choices[0].Message.Content
+
+		var result structuredReply
+		var problems []string
+		if err := json.Unmarshal([]byte(raw), &result); err != nil {
+			problems = []string{"the output is not valid JSON: " + err.Error()}
+		} else {
+			problems = validateStructuredReply(result, conversation)
+		}
+		if len(problems) == 0 {
+			return result.Reply, result.Verdict, nil
+		}
+
+		log.Printf("Некорректная оценка рисков (попытка %d): %s", attempt+1, strings.Join(problems, "; "))
+		messages = append(messages,
+			VisionMessage{Role: "assistant", Content: []VisionContentItem{{Type: "text", Text: raw}}},
+			VisionMessage{Role: "user", Content: []VisionContentItem{{Type: "text", Text: "Your JSON does not match the required format:\n- " +
+				strings.Join(problems, "\n- ") + "\nReturn the corrected JSON object only."}}},
+		)
+	}
+
+	reply, err := requestAssistantReply(persona, visionContents, meta)
+	// Неудачная серия стоит до verdictRepairAttempts+2 запросов за один кредит — её цена видна в логах
+	log.Printf("Не удалось получить корректную оценку рисков, возвращаем текстовый ответ: %d запросов к OpenAI, $%.4f",
+		meta.Usage.Requests-usageBefore.Requests, meta.Usage.CostUSD-usageBefore.CostUSD)
+	return reply, nil, err
+}
+
+// conversationText собирает текст переписки, отправленной модели, для проверки цитат в оценке рисков.
+// Картинки без расшифровки в него не попадают: цитату с них проверить нельзя.
+func conversationText(visionContents []VisionContentItem) string {
+	var parts []string
+	for _, item := range visionContents {
+		if item.Type == "text" {
+			parts = append(parts, item.Text)
+		}
+	}
+	return normalizeQuote(strings.Join(parts, "\n"))
+}
+
+// normalizeQuote приводит текст к виду для сравнения цитат: нижний регистр, пробелы схлопнуты,
+// кавычки вокруг цитаты убраны.
+func normalizeQuote(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	return strings.Trim(s, `"'«»“”„`)
+}
+
+// validateStructuredReply возвращает список нарушений схемы; пустой список — ответ корректен.
+// conversation — переписка после normalizeQuote: evidence каждого флага должна быть цитатой из неё.
+func validateStructuredReply(r structuredReply, conversation string) []string {
+	var problems []string
+	if strings.TrimSpace(r.Reply) == "" {
+		problems = append(problems, `"reply" must be a non-empty string`)
+	}
+	v := r.Verdict
+	if v == nil {
+		return append(problems, `"verdict" is missing`)
+	}
+	if v.RiskScore < 0 || v.RiskScore > 100 {
+		problems = append(problems, `"risk_score" must be an integer from 0 to 100`)
+	}
+	if v.Flags == nil {
+		v.Flags = []VerdictFlag{}
+	}
+	if len(v.Flags) > verdictMaxFlags {
+		problems = append(problems, fmt.Sprintf(`"flags" must contain at most %d items`, verdictMaxFlags))
+	}
+	for i, f := range v.Flags {
+		if !verdictCategories[f.Category] {
+			problems = append(problems, fmt.Sprintf(`flags[%d].category %q is not one of the allowed categories`, i, f.Category))
+		}
+		if !verdictSeverities[f.Severity] {
+			problems = append(problems, fmt.Sprintf(`flags[%d].severity %q must be low, medium or high`, i, f.Severity))
+		}
+		if evidence := normalizeQuote(f.Evidence); evidence == "" {
+			problems = append(problems, fmt.Sprintf(`flags[%d].evidence must quote the conversation`, i))
+		} else if !strings.Contains(conversation, evidence) {
+			problems = append(problems, fmt.Sprintf(`flags[%d].evidence is not an exact quote from the conversation`, i))
+		}
+		if strings.TrimSpace(f.Explanation) == "" {
+			problems = append(problems, fmt.Sprintf(`flags[%d].explanation must not be empty`, i))
+		}
+	}
+	return problems
+}
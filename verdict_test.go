@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateStructuredReply(t *testing.T) {
+	conversation := conversationText([]VisionContentItem{
+		{Type: "text", Text: "User: He said   \"You're Overreacting again\" when I asked where he was."},
+		{Type: "image_url", ImageURL: &VisionImageURL{URL: "https://example.com/a.png"}},
+		{Type: "text", Text: "Screenshot 1:\nHim: если уйдёшь — пожалеешь"},
+	})
+	flag := func(category, severity, evidence, explanation string) VerdictFlag {
+		return VerdictFlag{Category: category, Severity: severity, Evidence: evidence, Explanation: explanation}
+	}
+	valid := flag("gaslighting", "medium", "You're overreacting again", "Dismisses her feelings")
+	manyFlags := make([]VerdictFlag, verdictMaxFlags+1)
+	for i := range manyFlags {
+		manyFlags[i] = valid
+	}
+
+	tests := []struct {
+		name  string
+		reply structuredReply
+		want  []string // подстроки ожидаемых нарушений; nil — ответ корректен
+	}{
+		{"valid", structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: 40, Flags: []VerdictFlag{valid}}}, nil},
+		{"no flags", structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: 0}}, nil},
+		{"boundary scores", structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: 100}}, nil},
+		{"empty reply", structuredReply{Reply: "  ", Verdict: &Verdict{}}, []string{`"reply"`}},
+		{"missing verdict", structuredReply{Reply: "ok"}, []string{`"verdict" is missing`}},
+		{"negative score", structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: -1}}, []string{"risk_score"}},
+		{"score above 100", structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: 101}}, []string{"risk_score"}},
+		{"too many flags", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: manyFlags}}, []string{"at most"}},
+		{"unknown category and severity", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("rudeness", "critical", "You're overreacting again", "x"),
+		}}}, []string{"category", "severity"}},
+		{"empty evidence and explanation", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("other", "low", " ", ""),
+		}}}, []string{"must quote", "explanation"}},
+		{"quoted evidence with different case and spacing", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("gaslighting", "low", "«YOU'RE   overreacting again»", "x"),
+		}}}, nil},
+		{"evidence from screenshot transcript", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("pressure", "high", "если уйдёшь — пожалеешь", "x"),
+		}}}, nil},
+		{"invented evidence", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("aggression", "high", "I will hurt you", "x"),
+		}}}, []string{"not an exact quote"}},
+		{"paraphrased evidence", structuredReply{Reply: "ok", Verdict: &Verdict{Flags: []VerdictFlag{
+			flag("gaslighting", "medium", "You are overreacting again", "x"),
+		}}}, []string{"not an exact quote"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := validateStructuredReply(tt.reply, conversation)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d matching %q", problems, len(tt.want), tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problems[%d] = %q, want it to mention %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+// TestBuildTurnContentsQuotesCurrentScreenshots собирает контекст так же, как handleChatPost:
+// скриншоты текущего хода приходят картинками, а цитаты из них должны проходить проверку.
+func TestBuildTurnContentsQuotesCurrentScreenshots(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"signedURL": "/object/sign" + strings.TrimPrefix(r.URL.Path, "/storage/v1/object/sign")})
+	}))
+	defer storage.Close()
+	t.Setenv("SUPABASE_URL", storage.URL)
+	t.Setenv("SUPABASE_SERVICE_ROLE", "test")
+	t.Setenv("SUPABASE_BUCKET_NAME", "images")
+
+	history := []Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Что скажешь?", ImagePaths: []string{"u/1.png"}, ImageTranscripts: []ScreenshotTranscript{
+			{Path: "u/1.png", Number: 1, Lines: []ScreenshotLine{{Speaker: "Him", Message: "если уйдёшь — пожалеешь"}}},
+		}},
+	}
+	visionContents, err := buildTurnContents(history)
+	if err != nil {
+		t.Fatalf("buildTurnContents: %v", err)
+	}
+
+	images := 0
+	for _, item := range visionContents {
+		if item.Type == "image_url" {
+			images++
+		}
+	}
+	if images != 1 {
+		t.Errorf("image items = %d, want 1", images)
+	}
+
+	reply := structuredReply{Reply: "ok", Verdict: &Verdict{RiskScore: 70, Flags: []VerdictFlag{
+		{Category: "pressure", Severity: "high", Evidence: "если уйдёшь — пожалеешь", Explanation: "x"},
+	}}}
+	if problems := validateStructuredReply(reply, conversationText(visionContents)); len(problems) != 0 {
+		t.Errorf("evidence from the current screenshot rejected: %q", problems)
+	}
+}
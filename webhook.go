@@ -9,6 +9,14 @@ import (
 	"os"
 )
 
+// packMessages — сколько сообщений начисляет каждый пакет.
+var packMessages = map[string]int{
+	"com.40apps.redflagged.messages.10":   10,
+	"com.40apps.redflagged.messages.20":   20,
+	"com.40apps.redflagged.messages.100":  100,
+	"com.40apps.redflagged.messages.1001": 1000,
+}
+
 func revenueCatWebhookHandler(w http.ResponseWriter, r *http.Request) {
 	secretToken := "Bearer " + os.Getenv("REVENUE_CAT_WEBHOOK_TOKEN")
 
@@ -61,17 +69,8 @@ func handleRevenueCatEvent(data []byte) {
 				continue
 			}
 
-			var count int
-			switch productID {
-			case "com.40apps.redflagged.messages.10":
-				count = 10
-			case "com.40apps.redflagged.messages.20":
-				count = 20
-			case "com.40apps.redflagged.messages.100":
-				count = 100
-			case "com.40apps.redflagged.messages.1001":
-				count = 1000
-			default:
+			count, ok := packMessages[productID]
+			if !ok {
 				log.Printf("Неизвестный product_id: %s", productID)
 				continue
 			}